@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0xef53/go-sshwrapper"
+)
+
+// Separates the sections in the output of remoteFactsScript.
+// The leading newline protects from sections without a trailing newline.
+const factsSeparator = "\n--- keeper facts ---\n"
+
+// Returns a shell script that prints the host facts in sections: hostname, FQDN,
+// number of CPUs, network interfaces, addresses and the content of factFiles.
+func remoteFactsScript() string {
+	cmds := []string{
+		"hostname",
+		"hostname -f 2>/dev/null || hostname",
+		"nproc",
+		"ip -o link show",
+		"ip -o addr show",
+	}
+	for _, fname := range factFiles {
+		cmds = append(cmds, "cat "+fname+" 2>/dev/null")
+	}
+
+	sep := "echo; echo '" + strings.TrimSpace(factsSeparator) + "'\n"
+
+	return strings.Join(cmds, "\n"+sep) + "\n"
+}
+
+// Reads paths from stdin and prints the state of each one:
+// KIND MODE OWNER GROUP EXTRA PATH separated by tabs, where KIND is one of
+// L (symlink, EXTRA is the target), D (directory), F (regular file,
+// EXTRA is the SHA-256 checksum), O (other) or N (doesn't exist).
+const statScript = `while IFS= read -r p; do
+  if [ -L "$p" ]; then k=L; x=$(readlink "$p")
+  elif [ -d "$p" ]; then k=D; x=
+  elif [ -f "$p" ]; then k=F; x=$(sha256sum < "$p" | cut -d' ' -f1)
+  elif [ -e "$p" ]; then k=O; x=
+  else printf 'N\t\t\t\t\t%s\n' "$p"; continue
+  fi
+  printf '%s\t%s\t%s\t%s\n' "$k" "$(stat --printf '%a\t%U\t%G' "$p")" "$x" "$p"
+done
+`
+
+// Type RemoteFileState describes a file on the remote host.
+type RemoteFileState struct {
+	Kind   byte
+	Perms  os.FileMode
+	Owner  string
+	Group  string
+	Extra  string
+	Exists bool
+}
+
+// Runs cmd over conn with a given stdin and returns its stdout.
+func runOutput(conn *sshwrapper.SSHConn, cmd string, stdin io.Reader) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	if err := conn.Run(cmd, stdin, &stdout, &stderr); err != nil {
+		return nil, fmt.Errorf("%s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// Interface flags reported by "ip link" in the order of NetIf.Flags and their names there.
+var ipLinkFlags = [][2]string{
+	{"UP", "up"},
+	{"BROADCAST", "broadcast"},
+	{"LOOPBACK", "loopback"},
+	{"POINTOPOINT", "pointtopoint"},
+	{"MULTICAST", "multicast"},
+	{"LOWER_UP", "running"},
+}
+
+// Parses the output of "ip -o link show" and "ip -o addr show".
+func parseRemoteIfaces(links, addrs string) []NetIf {
+	byName := make(map[string]*NetIf)
+
+	var iflist []*NetIf
+
+	for _, line := range strings.Split(links, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		idx, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSuffix(fields[1], ":")
+		if i := strings.Index(name, "@"); i > 0 {
+			name = name[:i]
+		}
+		iface := newNetIf(idx, name)
+		flags := make(StringSet)
+		flags.Add(strings.Split(strings.Trim(fields[2], "<>"), ",")...)
+		for _, f := range ipLinkFlags {
+			if flags.Has(f[0]) {
+				iface.Flags = append(iface.Flags, f[1])
+			}
+		}
+		for i := 3; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "mtu":
+				iface.MTU, _ = strconv.Atoi(fields[i+1])
+			case "link/ether":
+				iface.Hwaddr = fields[i+1]
+			}
+		}
+		byName[name] = &iface
+		iflist = append(iflist, &iface)
+	}
+
+	for _, line := range strings.Split(addrs, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		iface, ok := byName[fields[1]]
+		if !ok {
+			continue
+		}
+		if fields[2] != "inet" && fields[2] != "inet6" {
+			continue
+		}
+		if ip, ipnet, err := net.ParseCIDR(fields[3]); err == nil {
+			iface.addAddr(&net.IPNet{IP: ip, Mask: ipnet.Mask})
+		}
+	}
+
+	sort.Slice(iflist, func(i, j int) bool { return iflist[i].Index < iflist[j].Index })
+
+	res := make([]NetIf, 0, len(iflist))
+	for _, iface := range iflist {
+		res = append(res, *iface)
+	}
+
+	return res
+}
+
+// Gathers the template variables of the remote host: hostname, network
+// interfaces, facts and the custom variables (see loadCustomVariables) with
+// the output of the local ./myenvs executed on the host.
+func gatherRemoteVariables(conn *sshwrapper.SSHConn) (*Variables, error) {
+	out, err := runOutput(conn, remoteFactsScript(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("gathering facts: %s", err)
+	}
+
+	sections := strings.Split(string(out), factsSeparator)
+	if len(sections) != 5+len(factFiles) {
+		return nil, fmt.Errorf("gathering facts: unexpected output")
+	}
+
+	files := make([][]byte, len(factFiles))
+	for i := range factFiles {
+		files[i] = []byte(sections[5+i])
+	}
+
+	cpus, _ := strconv.Atoi(strings.TrimSpace(sections[2]))
+
+	vars := Variables{
+		Hostname: strings.TrimSpace(sections[0]),
+		Network:  parseRemoteIfaces(sections[3], sections[4]),
+		Facts:    *parseFacts(strings.TrimSpace(sections[1]), cpus, files),
+	}
+
+	var myenvs []byte
+
+	switch script, err := ioutil.ReadFile("./myenvs"); {
+	case err == nil:
+		// The script is uploaded to a temporary file and executed there
+		cmd := `t=$(mktemp) && cat > "$t" && chmod 700 "$t" && "$t"; rc=$?; rm -f "$t"; exit $rc`
+		out, err := runOutput(conn, cmd, bytes.NewReader(script))
+		if err != nil {
+			return nil, fmt.Errorf("myenvs: %s", err)
+		}
+		myenvs = out
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	labels, err := hostLabels(vars.Hostname, vars.Facts.FQDN)
+	if err != nil {
+		return nil, err
+	}
+	vars.Labels = labels
+
+	x, err := loadCustomVariables(vars.Hostname, vars.Facts.FQDN, myenvs)
+	if err != nil {
+		return nil, err
+	}
+	vars.X = x
+
+	return &vars, nil
+}
+
+// Returns the states of given paths on the remote host.
+func remoteFileStates(conn *sshwrapper.SSHConn, paths []string) (map[string]RemoteFileState, error) {
+	out, err := runOutput(conn, statScript, strings.NewReader(strings.Join(paths, "\n")+"\n"))
+	if err != nil {
+		return nil, fmt.Errorf("checking files: %s", err)
+	}
+
+	states := make(map[string]RemoteFileState, len(paths))
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.SplitN(line, "\t", 6)
+		if len(fields) != 6 || fields[0] == "" {
+			continue
+		}
+		st := RemoteFileState{
+			Kind:   fields[0][0],
+			Owner:  fields[2],
+			Group:  fields[3],
+			Extra:  fields[4],
+			Exists: fields[0] != "N",
+		}
+		if st.Exists {
+			perms, err := strconv.ParseUint(fields[1], 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("checking files: %s: %s", fields[5], err)
+			}
+			st.Perms = os.FileMode(perms)
+		}
+		states[fields[5]] = st
+	}
+
+	return states, nil
+}
+
+// Directory on remote hosts where remote-apply saves the files it overwrites
+// or removes. Each run has its own subdirectory named by the start time with
+// the saved files under their full paths, e.g. /var/backups/keeper/20240101-120000/files/etc/hosts.
+// They are copied with "cp -a", so the mode and owner are kept.
+const remoteBackupsDir = "/var/backups/keeper"
+
+// Type applyFile is a repository file prepared to be applied to the remote host.
+type applyFile struct {
+	*RepositoryFile
+	Content []byte
+	Target  string
+	// Backup run directory on the remote host
+	BackupDir string
+}
+
+// Same as RepositoryFile.keepLocalAttributes for the file on the remote host.
+func (rf *RepositoryFile) keepRemoteAttributes(st RemoteFileState) {
+	if rf.Edit == "" || st.Kind != 'F' {
+		return
+	}
+	if rf.Perms == 0 {
+		rf.Mode = (rf.Mode &^ (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)) | permsToFileMode(st.Perms)
+	}
+	if !rf.ownerSet {
+		rf.cfgOwner = st.Owner
+	}
+	if !rf.groupSet {
+		rf.cfgGroup = st.Group
+	}
+}
+
+// Returns true if the remote file is the same as the file from repository.
+func (f *applyFile) matches(st RemoteFileState) bool {
+	if f.State == StateAbsent {
+		return !st.Exists
+	}
+	if !st.Exists {
+		return false
+	}
+
+	switch {
+	case f.Mode&os.ModeSymlink != 0:
+		return st.Kind == 'L' && st.Extra == f.Target
+	case st.Perms != fileModeToPerms(f.Mode) || st.Owner != f.cfgOwner || st.Group != f.cfgGroup:
+		return false
+	case f.Mode.IsDir():
+		return st.Kind == 'D'
+	case f.Mode.IsRegular():
+		sum := sha256.Sum256(f.Content)
+		return st.Kind == 'F' && st.Extra == hex.EncodeToString(sum[:])
+	}
+
+	return true
+}
+
+// Returns a shell script that makes the remote file the same as the file from repository.
+// The content of regular files is read from stdin.
+func (f *applyFile) script() string {
+	p := shellQuote(f.FSPath)
+	perms := fmt.Sprintf("%04o", fileModeToPerms(f.Mode))
+	owner := shellQuote(f.cfgOwner + ":" + f.cfgGroup)
+
+	s := "set -e; p=" + p + "; "
+
+	if f.BackupDir != "" && (f.State == StateAbsent || !f.Mode.IsDir()) {
+		// The existing file (or the whole tree for the recursive removal) is saved before it's replaced
+		s += "b=" + shellQuote(path.Join(f.BackupDir, "files")) + `"$p"; `
+		s += `if [ -e "$p" ] || [ -L "$p" ]; then (umask 077; mkdir -p "$(dirname "$b")"); rm -rf "$b"; cp -a "$p" "$b"; fi; `
+	}
+
+	switch {
+	case f.State == StateAbsent && f.Recursive:
+		s += `rm -rf "$p"`
+	case f.State == StateAbsent:
+		s += `if [ -d "$p" ] && [ ! -L "$p" ]; then rmdir "$p"; else rm -f "$p"; fi`
+	case f.Mode.IsDir():
+		s += `[ ! -e "$p" ] || [ -d "$p" ] || { echo "non directory destination already exists: $p" >&2; exit 1; }; `
+		s += `mkdir -p "$p"; chmod ` + perms + ` "$p"; chown ` + owner + ` "$p"`
+	case f.Mode&os.ModeSymlink != 0:
+		s += `[ ! -d "$p" ] || [ -L "$p" ] || { echo "non symbolic link destination file already exists: $p" >&2; exit 1; }; `
+		s += `t="$p.keeper$$"; ln -s ` + shellQuote(f.Target) + ` "$t"; mv -Tf "$t" "$p"`
+	default:
+		s += `[ ! -d "$p" ] || [ -L "$p" ] || { echo "non regular destination file already exists: $p" >&2; exit 1; }; `
+		s += `t=$(mktemp "$(dirname "$p")/.keeperXXXXXX"); trap 'rm -f "$t"' EXIT; `
+		s += `cat > "$t"; chmod ` + perms + ` "$t"; chown ` + owner + ` "$t"; `
+		if f.Check != "" {
+			s += `{ ` + checkCommand(f.Check, `"$t"`) + `; } >&2 || { echo "check failed: $p" >&2; exit 1; }; `
+		}
+		s += `mv -f "$t" "$p"`
+	}
+
+	return s
+}
+
+func (f *applyFile) String() string {
+	x := *f.RepositoryFile
+	x.Owner, x.Group = f.cfgOwner, f.cfgGroup
+	return x.String()
+}
+
+// Returns the repository files of given layers that can be applied to a remote host
+// with given variables and the on_change commands of their directories.
+func collectRepositoryFiles(layers []Layer, vars *Variables) ([]*RepositoryFile, DirHooks, error) {
+	var files []*RepositoryFile
+
+	hooks := make(DirHooks)
+
+	cf := conditionFilter{vars: vars}
+
+	for _, lp := range walkLayers(layers) {
+		rf, err := NewRepositoryFile(lp.Path, lp.Layer)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch skip, err := cf.Skip(rf); {
+		case err != nil:
+			return nil, nil, err
+		case skip:
+			continue
+		}
+		hooks.Register(rf)
+		if IGNORED_DIRS.Has(rf.FSPath) {
+			continue
+		}
+		files = append(files, rf)
+	}
+
+	return files, hooks, nil
+}
+
+// Returns a session that renders the repository files with the facts of the remote host,
+// compares them with the remote files and uploads only the changed ones.
+// The files are taken from the layers of the remote host. Overwritten and removed files
+// are saved into a backup run directory under remoteBackupsDir on the remote host.
+func applySession() RemoteSession {
+	backupDir := path.Join(remoteBackupsDir, time.Now().Format("20060102-150405"))
+
+	return func(ctx context.Context, conn *sshwrapper.SSHConn, stdout, stderr io.Writer) error {
+		vars, err := gatherRemoteVariables(conn)
+		if err != nil {
+			return err
+		}
+
+		layers, err := hostLayers(vars.Hostname)
+		if err != nil {
+			return err
+		}
+
+		files, dirs, err := collectRepositoryFiles(layers, vars)
+		if err != nil {
+			return err
+		}
+
+		paths := make([]string, 0, len(files))
+		for _, rf := range files {
+			paths = append(paths, rf.FSPath)
+		}
+
+		states, err := remoteFileStates(conn, paths)
+		if err != nil {
+			return err
+		}
+
+		var failed int
+		var hooks []string
+
+		for _, rf := range files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			f := applyFile{RepositoryFile: rf, BackupDir: backupDir}
+
+			switch {
+			case rf.State == StateAbsent:
+			case rf.Mode&os.ModeSymlink != 0:
+				f.Target, err = os.Readlink(rf.Path)
+			case rf.Mode.IsRegular() && rf.IsTemplate:
+				f.Content, err = renderTemplateWith(rf.Path, vars)
+			case rf.Mode.IsRegular():
+				f.Content, err = ioutil.ReadFile(rf.Path)
+			}
+			if err == nil && rf.Edit != "" {
+				// Edits are applied to the current content of the remote file
+				// and keep its attributes
+				rf.keepRemoteAttributes(states[rf.FSPath])
+				var current []byte
+				if states[rf.FSPath].Kind == 'F' {
+					current, err = runOutput(conn, "cat "+shellQuote(rf.FSPath), nil)
+				}
+				if err == nil {
+					f.Content, err = rf.applyEdit(current, f.Content)
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "[Warn] %s: %s\n", rf.FSPath, err)
+				failed++
+				continue
+			}
+
+			if f.matches(states[rf.FSPath]) {
+				if VERBOSE {
+					fmt.Fprintln(stdout, f.String())
+				}
+				continue
+			}
+
+			if !DRYRUN {
+				if _, err := runOutput(conn, f.script(), bytes.NewReader(f.Content)); err != nil {
+					fmt.Fprintf(stderr, "[Warn] %s: %s\n", rf.FSPath, err)
+					failed++
+					continue
+				}
+			}
+
+			fmt.Fprintln(stdout, f.String())
+
+			hooks = dirs.Collect(rf, hooks)
+		}
+
+		for _, cmd := range hooks {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(stdout, " $ %s\n", cmd)
+			if DRYRUN {
+				continue
+			}
+			if err := conn.Run(cmd, nil, stdout, stderr); err != nil {
+				fmt.Fprintf(stderr, "[Warn] %q: %s\n", cmd, err)
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d operations failed", failed)
+		}
+
+		return nil
+	}
+}
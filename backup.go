@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// Directory of the current backup run; it's created on first backup
+	backupRunDir string
+	// Files that have been already backed up on current run
+	backedUpFiles = make(StringSet)
+)
+
+// Type describes a file/directory saved in a backup run.
+type BackupEntry struct {
+	Path string
+	Mode os.FileMode
+	Uid  int
+	Gid  int
+}
+
+// Creates a new backup run directory under BACKUPS_DIR named by the current time.
+func newBackupRun() (string, error) {
+	if err := os.MkdirAll(BACKUPS_DIR, 0700); err != nil {
+		return "", err
+	}
+
+	id := time.Now().Format("20060102-150405")
+	for i := 1; ; i++ {
+		dir := path.Join(BACKUPS_DIR, id)
+		switch err := os.Mkdir(dir, 0700); {
+		case err == nil:
+			return dir, nil
+		case !os.IsExist(err):
+			return "", err
+		}
+		id = fmt.Sprintf("%s.%d", time.Now().Format("20060102-150405"), i)
+	}
+}
+
+// Saves the content (or the link target) of fspath together with its original
+// mode and owner/group into the current backup run. Does nothing if fspath doesn't exist.
+func backupFile(fspath string) error {
+	if backedUpFiles.Has(fspath) {
+		return nil
+	}
+
+	fi, err := os.Lstat(fspath)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if backupRunDir == "" {
+		d, err := newBackupRun()
+		if err != nil {
+			return fmt.Errorf("cannot create backup run: %s", err)
+		}
+		backupRunDir = d
+	}
+
+	dst := path.Join(backupRunDir, "files", fspath)
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	switch {
+	case fi.IsDir():
+		// Only the attributes of directories are saved
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(fspath)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+	case fi.Mode().IsRegular():
+		if err := copyFileContents(fspath, dst, 0600, os.Getuid(), os.Getgid(), ""); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	var uid, gid int
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		uid, gid = int(st.Uid), int(st.Gid)
+	}
+
+	f, err := os.OpenFile(path.Join(backupRunDir, "index"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%d %d %d %s\n", uint32(fi.Mode()), uid, gid, fspath); err != nil {
+		return err
+	}
+
+	backedUpFiles.Add(fspath)
+
+	return f.Close()
+}
+
+// Returns a sorted list of the existing backup run IDs.
+func listBackupRuns() ([]string, error) {
+	fis, err := ioutil.ReadDir(BACKUPS_DIR)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	runs := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if fi.IsDir() {
+			runs = append(runs, fi.Name())
+		}
+	}
+	sort.Strings(runs)
+
+	return runs, nil
+}
+
+// Reads the index of a given backup run. Entries are sorted by path,
+// so parent directories always precede their content.
+func readBackupIndex(runID string) ([]BackupEntry, error) {
+	fname := path.Join(BACKUPS_DIR, runID, "index")
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []BackupEntry
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		var e BackupEntry
+		mode, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fname, err)
+		}
+		e.Mode = os.FileMode(mode)
+		if e.Uid, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s: %s", fname, err)
+		}
+		if e.Gid, err = strconv.Atoi(fields[2]); err != nil {
+			return nil, fmt.Errorf("%s: %s", fname, err)
+		}
+		e.Path = fields[3]
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", fname, err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	return entries, nil
+}
+
+// Puts a backed up file/directory back to its original place
+// and sets the saved access attributes and the owner/group.
+func restoreEntry(runID string, e BackupEntry) error {
+	src := path.Join(BACKUPS_DIR, runID, "files", e.Path)
+
+	if err := os.MkdirAll(filepath.Dir(e.Path), 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case e.Mode.IsDir():
+		switch dfi, err := os.Lstat(e.Path); {
+		case err == nil:
+			if !dfi.IsDir() {
+				return fmt.Errorf("non directory destination already exists: %s (%q)", e.Path, dfi.Mode().String())
+			}
+		case !os.IsNotExist(err):
+			return err
+		}
+		if err := os.MkdirAll(e.Path, 0755); err != nil {
+			return err
+		}
+		if err := os.Chmod(e.Path, e.Mode); err != nil {
+			return err
+		}
+		return os.Chown(e.Path, e.Uid, e.Gid)
+	case e.Mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		switch dfi, err := os.Lstat(e.Path); {
+		case err == nil:
+			if dfi.IsDir() {
+				return fmt.Errorf("directory destination already exists: %s", e.Path)
+			}
+			if err := os.Remove(e.Path); err != nil {
+				return err
+			}
+		case !os.IsNotExist(err):
+			return err
+		}
+		if err := os.Symlink(target, e.Path); err != nil {
+			return err
+		}
+		return os.Lchown(e.Path, e.Uid, e.Gid)
+	case e.Mode.IsRegular():
+		if dfi, err := os.Lstat(e.Path); err == nil && dfi.IsDir() {
+			return fmt.Errorf("directory destination already exists: %s", e.Path)
+		}
+		return copyFileContents(src, e.Path, e.Mode, e.Uid, e.Gid, "")
+	}
+
+	return nil
+}
+
+func (e BackupEntry) String() string {
+	return fmt.Sprintf(" %s %d:%d %s", e.Mode, e.Uid, e.Gid, e.Path)
+}
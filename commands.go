@@ -2,10 +2,15 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"strings"
 	"syscall"
@@ -54,23 +59,39 @@ git submodule update
 	return os.Rename(tmpfile, githook)
 }
 
-// Syncs each file/directory from BASEDIR directory to the file system.
+// Syncs each file/directory from the host's layers (see hostLayers) to the file system.
 // Cleans removed files/directories at the end.
 func syncRepo() error {
 	if DRYRUN {
 		fmt.Fprintln(os.Stderr, "( !!! running with option DRYRUN, nothing to do !!! )")
 	}
 
-	fmt.Println("--> Updating configuration files:")
+	layers, err := hostLayers(ENVS.Hostname)
+	if err != nil {
+		return err
+	}
+
+	textln("--> Updating configuration files:")
+
+	cf := conditionFilter{vars: ENVS}
+
+	for _, lp := range walkLayers(layers) {
+		if err := syncFile(lp, &cf); err != nil {
+			warn(err)
+		}
+	}
 
-	for p := range walk(BASEDIR) {
-		if err := syncFile(p); err != nil {
+	// Files with broken conditions are not handled,
+	// so they must not be removed as deleted ones
+	if cf.failed > 0 {
+		if err := runHooks(); err != nil {
 			warn(err)
 		}
+		return fmt.Errorf("%d conditions could not be evaluated, deleted files are not removed", cf.failed)
 	}
 
-	fmt.Println()
-	fmt.Println("--> Removing deleted files:")
+	textln()
+	textln("--> Removing deleted files:")
 
 	if err := removeDeleted(); err != nil {
 		return fmt.Errorf("removing deleted files: %s", err)
@@ -97,40 +118,154 @@ func syncRepo() error {
 		}
 	}
 
-	return nil
+	if backupRunDir != "" {
+		textln()
+		textf("--> Overwritten files have been saved to the backup run %s\n", path.Base(backupRunDir))
+	}
+
+	return runHooks()
 }
 
-func syncFile(p string) error {
-	repofile, err := NewRepositoryFile(p)
+func syncFile(lp LayerPath, cf *conditionFilter) error {
+	repofile, err := NewRepositoryFile(lp.Path, lp.Layer)
 	if err != nil {
 		return err
 	}
 
+	// Not handled files are removed if they were deployed before
+	switch skip, err := cf.Skip(repofile); {
+	case err != nil:
+		return err
+	case skip:
+		if VERBOSE && !JSON_OUTPUT {
+			fmt.Printf("   %s%s  (skipped by condition)\n", repofile.Layer, repofile.FSPath)
+		}
+		return nil
+	}
+
+	dirHooks.Register(repofile)
+
 	if IGNORED_DIRS.Has(repofile.FSPath) {
 		return nil
 	}
 
-	HANDLED_FILES.Add(repofile.FSPath)
+	repofile.keepLocalAttributes()
+
+	switch {
+	case repofile.State == StateAbsent:
+		// Absent files must not be in the file list, they don't exist
+	case repofile.Edit != "":
+		EDITED_FILES.Add(repofile.FSPath)
+	default:
+		HANDLED_FILES.Add(repofile.FSPath)
+	}
 
-	if repofile.Exists() {
-		if VERBOSE {
+	ev := newRepoFileEvent(repofile)
+	if repofile.State == StateAbsent {
+		ev.Action = "remove"
+	}
+
+	switch exists, err := repofile.Exists(); {
+	case err != nil:
+		if JSON_OUTPUT {
+			ev.Error = err.Error()
+			emitEvent(ev)
+		}
+		return err
+	case exists:
+		switch {
+		case JSON_OUTPUT:
+			ev.Action = "skip"
+			emitEvent(ev)
+		case VERBOSE:
 			fmt.Println(repofile)
 		}
 		return nil
 	}
 
-	if DRYRUN {
-		fmt.Println(repofile)
-		return nil
+	// The diff has to be made before the file is changed
+	if SHOW_DIFF {
+		d, err := repofile.Diff()
+		if err != nil {
+			return err
+		}
+		ev.Diff = d
 	}
 
-	switch err := repofile.Sync(); {
-	case err == nil:
-		fmt.Println(repofile)
+	if !DRYRUN {
+		if err := repofile.Sync(); err != nil {
+			if JSON_OUTPUT {
+				ev.Error = err.Error()
+				emitEvent(ev)
+			}
+			return err
+		}
+	}
+
+	switch {
+	case JSON_OUTPUT:
+		emitEvent(ev)
 	default:
+		fmt.Println(repofile)
+		fmt.Print(ev.Diff)
+	}
+
+	scheduleHooks(repofile)
+
+	return nil
+}
+
+// Prints the differences between repository files and the file system
+// without changing anything. If paths are given, only these paths
+// and their content are compared.
+func diffRepo(paths []string) error {
+	paths, err := absPaths(paths)
+	if err != nil {
+		return err
+	}
+
+	layers, err := hostLayers(ENVS.Hostname)
+	if err != nil {
 		return err
 	}
 
+	cf := conditionFilter{vars: ENVS}
+
+	for _, lp := range walkLayers(layers) {
+		repofile, err := NewRepositoryFile(lp.Path, lp.Layer)
+		if err != nil {
+			warn(err)
+			continue
+		}
+		switch skip, err := cf.Skip(repofile); {
+		case err != nil:
+			warn(err)
+			continue
+		case skip:
+			continue
+		}
+		repofile.keepLocalAttributes()
+		if IGNORED_DIRS.Has(repofile.FSPath) || !underPaths(repofile.FSPath, paths) {
+			continue
+		}
+		switch exists, err := repofile.Exists(); {
+		case err != nil:
+			warn(fmt.Sprintf("%s: %s", repofile.FSPath, err))
+			continue
+		case exists:
+			continue
+		}
+		diff, err := repofile.Diff()
+		if err != nil {
+			warn(fmt.Sprintf("%s: %s", repofile.FSPath, err))
+			continue
+		}
+		if diff != "" {
+			fmt.Println(repofile)
+			fmt.Println(diff)
+		}
+	}
+
 	return nil
 }
 
@@ -159,7 +294,7 @@ func removeDeleted() error {
 
 	diff := make(StringSet)
 	for file := range prevHandled {
-		if !HANDLED_FILES.Has(file) {
+		if !HANDLED_FILES.Has(file) && !EDITED_FILES.Has(file) {
 			diff.Add(file)
 		}
 	}
@@ -180,14 +315,20 @@ func removeDeleted() error {
 			return err
 		}
 
+		ev := newFSEvent("remove", file)
+
 		if DRYRUN {
-			fmt.Printf(" -f %s\n", file)
+			reportRemoved("f", ev)
 			continue
 		}
 
+		if err := backupFile(file); err != nil {
+			return err
+		}
+
 		switch err := os.Remove(file); {
 		case err == nil || os.IsNotExist(err):
-			fmt.Printf(" -f %s\n", file)
+			reportRemoved("f", ev)
 		default:
 			return err
 		}
@@ -195,17 +336,29 @@ func removeDeleted() error {
 
 	// Removing directories
 	for dir, _ := range diff {
+		ev := newFSEvent("remove", dir)
+
 		if DRYRUN {
-			fmt.Printf(" -d %s\n", dir)
+			reportRemoved("d", ev)
 			continue
 		}
 
+		if err := backupFile(dir); err != nil {
+			return err
+		}
+
 		switch err := os.Remove(dir); {
 		case err == nil || os.IsNotExist(err):
-			fmt.Printf(" -d %s\n", dir)
+			reportRemoved("d", ev)
 		default:
 			if _err, ok := err.(*os.PathError); ok && _err.Err == syscall.ENOTEMPTY {
-				fmt.Printf(" -d %s (directory not empty so not removed)\n", dir)
+				if JSON_OUTPUT {
+					ev.Action = "skip"
+					ev.Error = "directory not empty so not removed"
+					emitEvent(ev)
+				} else {
+					fmt.Printf(" -d %s (directory not empty so not removed)\n", dir)
+				}
 			} else {
 				return err
 			}
@@ -215,27 +368,347 @@ func removeDeleted() error {
 	return nil
 }
 
-func remoteCommand(cmd string, hosts []string) error {
+// Reports a removed file (kind "f") or directory (kind "d").
+func reportRemoved(kind string, ev *SyncEvent) {
+	switch {
+	case JSON_OUTPUT:
+		emitEvent(ev)
+	default:
+		fmt.Printf(" -%s %s\n", kind, ev.Path)
+	}
+}
+
+// Updates the repository in repodir on remote agents and runs "keeper sync" there.
+// In pull mode the repository is updated by "git pull", in push mode the local
+// repository is packed and streamed to the agents.
+func remoteSync(repodir string, hosts []string, rollout *RolloutStrategy) error {
+	cmd := "keeper sync"
+	if SHOW_DIFF {
+		cmd += " -diff"
+	}
+	if JSON_OUTPUT {
+		cmd += " -format json"
+	}
+	if DRYRUN {
+		cmd = "DRYRUN=1 " + cmd
+	}
+
+	if !PUSH_MODE {
+		cmd = "MANUAL=1 git pull; " + cmd
+		cmd = "cd " + repodir + "; " + cmd
+
+		return remoteCommand(cmd, hosts, rollout, remoteOptions())
+	}
+
+	script, err := unpackScript(repodir, DRYRUN)
+	if err != nil {
+		return err
+	}
+
+	archive, err := packRepository(PUSH_REV)
+	if err != nil {
+		return fmt.Errorf("packing error: %s", err)
+	}
+	defer os.Remove(archive)
+
+	opts := remoteOptions()
+	opts.Stdin = archive
+
+	return remoteCommand(script+cmd, hosts, rollout, opts)
+}
+
+// Renders the repository files for each remote host using its facts and
+// uploads the changed files over SSH. Keeper isn't required on the hosts.
+func remoteApply(hosts []string) error {
+	opts := remoteOptions()
+	opts.Session = applySession()
+
+	// Nothing is run on the hosts but the uploads, the label is shown as the command
+	return remoteCommand("apply (rendered locally)", hosts, nil, opts)
+}
+
+// Returns the options of remote execution defined in the command line.
+func remoteOptions() RemoteOptions {
+	return RemoteOptions{
+		Concurrency:  CONCURRENCY,
+		ForwardAgent: FORWARD_AGENT,
+		JSONOutput:   JSON_OUTPUT,
+		Timeout:      HOST_TIMEOUT,
+		FailFast:     FAIL_FAST,
+		Stream:       STREAM,
+		Color:        COLOR,
+		OutDir:       OUT_DIR,
+	}
+}
+
+func remoteCommand(cmd string, hosts []string, rollout *RolloutStrategy, opts RemoteOptions) error {
 	agents, err := ParseRemoteAgents(hosts)
 	if err != nil {
 		return fmt.Errorf("agents parsing error: %s", err)
 	}
 
-	if CONCURRENCY < 1 {
-		CONCURRENCY = 1
+	// Ctrl-C cancels running sessions and pending agents
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The second Ctrl-C terminates the program immediately
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	var results []HostResult
+
+	switch {
+	case rollout != nil:
+		results = rolloutRemoteCmd(ctx, agents, cmd, opts, rollout)
+	default:
+		results = execRemoteCmd(ctx, agents, cmd, opts)
 	}
 
-	if errors := execRemoteCmd(agents, cmd, CONCURRENCY, FORWARD_AGENT); len(errors) > 0 {
-		for _, err := range errors {
-			warn(err)
+	var failed, skipped int
+	for _, r := range results {
+		switch {
+		case r.Status == StatusSkipped:
+			skipped++
+		case r.Err != nil:
+			warn(fmt.Sprintf("%s: %s", r.Agent.Host, r.Err))
+			failed++
 		}
 	}
 
+	if !JSON_OUTPUT {
+		printRemoteSummary(results)
+	}
+
+	switch {
+	case failed > 0 && skipped > 0:
+		return fmt.Errorf("%d of %d hosts failed, %d skipped", failed, len(results), skipped)
+	case failed > 0:
+		return fmt.Errorf("%d of %d hosts failed", failed, len(results))
+	case skipped > 0:
+		return fmt.Errorf("%d of %d hosts skipped", skipped, len(results))
+	}
+
 	return nil
 }
 
 // Tries to execute a given template file and writes results
-// to the standard output on success.
+// to the standard output on success. Templates that use secrets
+// are printed only if SHOW_SECRETS is set.
 func testTemplate(tplname string) error {
-	return executeTemplate(tplname, "", 0, 0, 0)
+	b, used, err := renderTemplateSecrets(tplname, ENVS)
+	if err != nil {
+		return err
+	}
+
+	if used && !SHOW_SECRETS {
+		return fmt.Errorf("the template uses secrets, use -show-secrets to print it")
+	}
+
+	_, err = os.Stdout.Write(b)
+
+	return err
+}
+
+// Prints all variables available in templates.
+func printVariables() error {
+	b, err := json.MarshalIndent(ENVS, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(append(b, '\n'))
+
+	return err
+}
+
+// Prints the existing backup runs with their content.
+func listBackups() error {
+	runs, err := listBackupRuns()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range runs {
+		entries, err := readBackupIndex(id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("--> %s:\n", id)
+		for _, e := range entries {
+			fmt.Println(e)
+		}
+		fmt.Println()
+	}
+
+	return nil
+}
+
+// Restores files/directories from a given backup run (or from the latest one
+// if runID is empty). If paths are given, only these paths and their content are restored.
+func restoreBackup(runID string, paths []string) error {
+	paths, err := absPaths(paths)
+	if err != nil {
+		return err
+	}
+
+	if runID == "" {
+		runs, err := listBackupRuns()
+		if err != nil {
+			return err
+		}
+		if len(runs) == 0 {
+			return fmt.Errorf("no backups found")
+		}
+		runID = runs[len(runs)-1]
+	}
+
+	entries, err := readBackupIndex(runID)
+	if err != nil {
+		return err
+	}
+
+	if DRYRUN {
+		fmt.Fprintln(os.Stderr, "( !!! running with option DRYRUN, nothing to do !!! )")
+	}
+
+	fmt.Printf("--> Restoring files from the backup run %s:\n", runID)
+
+	for _, e := range entries {
+		if !underPaths(e.Path, paths) {
+			continue
+		}
+		if DRYRUN {
+			fmt.Println(e)
+			continue
+		}
+		// Current state is saved too, so the restoring can be undone
+		if err := backupFile(e.Path); err != nil {
+			warn(err)
+			continue
+		}
+		if err := restoreEntry(runID, e); err != nil {
+			warn(err)
+			continue
+		}
+		fmt.Println(e)
+	}
+
+	return nil
+}
+
+// Generates the private key of this host and prints the public key
+// that should be added to the list of recipients.
+func secretKeygen() error {
+	pub, err := generateSecretKey()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(pub)
+
+	fmt.Fprintf(os.Stderr, "Add the public key to %s and run 'keeper secret edit NAME'\n", path.Join(SECRETS_DIR, "recipients"))
+	fmt.Fprintln(os.Stderr, "on a host that can decrypt the secrets to re-encrypt them")
+
+	return nil
+}
+
+// Encrypts a YAML document from srcname (or from the standard input)
+// and saves it as a secret with a given name.
+func secretEncrypt(name, srcname string) error {
+	fname, err := secretFile(name)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+
+	switch srcname {
+	case "", "-":
+		data, err = ioutil.ReadAll(os.Stdin)
+	default:
+		data, err = ioutil.ReadFile(srcname)
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeSecret(fname, data)
+}
+
+// Decrypts a secret into a temporary file, opens it in the $EDITOR
+// and encrypts the result for the current list of recipients. The temporary file
+// is kept in a private directory under KEEPER_SYSDIR rather than in the shared
+// temporary directory and is removed when the editor exits.
+func secretEdit(name string) error {
+	fname, err := secretFile(name)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+
+	switch _, err := os.Stat(fname); {
+	case err == nil:
+		if data, err = readSecret(fname); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	if err := os.MkdirAll(KEEPER_SYSDIR, 0700); err != nil {
+		return err
+	}
+	// The directory is created with mode 0700
+	tmpdir, err := ioutil.TempDir(KEEPER_SYSDIR, ".secret_edit_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// The signals are handled by the editor, keeper must not exit before it
+	// and leave the plaintext behind
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	tmpfile := path.Join(tmpdir, name+".yaml")
+
+	if err := ioutil.WriteFile(tmpfile, data, 0600); err != nil {
+		return err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", editor+" "+shellQuote(tmpfile))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", editor, err)
+	}
+
+	newData, err := ioutil.ReadFile(tmpfile)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(data, newData) {
+		// The unchanged secret is re-encrypted only if the recipients have changed
+		switch changed, err := recipientsChanged(fname); {
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		case changed:
+			return writeSecret(fname, newData)
+		}
+		fmt.Fprintln(os.Stderr, "No changes")
+		return nil
+	}
+
+	return writeSecret(fname, newData)
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// Type Condition defines the hosts a repository file is deployed to
+// (the "when" parameter). It is either a template expression:
+//
+//	when: 'eq .Facts.OS.ID "debian"'
+//
+// or a set of rules that all must match:
+//
+//	when:
+//	  hostname: "db*"           # glob pattern for the hostname or FQDN
+//	  labels: dc=ams,role!=web  # inventory labels, see InventoryHost.matchLabels
+//	  expr: '{{ gt .Facts.CPUs 4 }}'
+type Condition struct {
+	Hostname string `yaml:"hostname"`
+	Labels   string `yaml:"labels"`
+	Expr     string `yaml:"expr"`
+}
+
+func (c *Condition) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var expr string
+	if err := unmarshal(&expr); err == nil {
+		*c = Condition{Expr: expr}
+		return nil
+	}
+
+	type rawCondition Condition
+
+	var v rawCondition
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	*c = Condition(v)
+
+	return nil
+}
+
+func (c *Condition) IsEmpty() bool {
+	return c.Hostname == "" && c.Labels == "" && strings.TrimSpace(c.Expr) == ""
+}
+
+// Checks whether the condition matches a host with given variables.
+func (c *Condition) Match(vars *Variables) (bool, error) {
+	if c.Hostname != "" {
+		m1, err := path.Match(c.Hostname, vars.Hostname)
+		if err != nil {
+			return false, err
+		}
+		m2, _ := path.Match(c.Hostname, vars.Facts.FQDN)
+		if !m1 && !m2 {
+			return false, nil
+		}
+	}
+
+	if c.Labels != "" {
+		h := InventoryHost{Labels: vars.Labels}
+		if ok, err := h.matchLabels(c.Labels); err != nil || !ok {
+			return false, err
+		}
+	}
+
+	if strings.TrimSpace(c.Expr) != "" {
+		return evalExpr(c.Expr, vars)
+	}
+
+	return true, nil
+}
+
+// Evaluates a template expression with given variables. The expression
+// may be given with or without the surrounding braces. The result is false
+// if it is empty, "false", "0" or a missing value.
+func evalExpr(expr string, vars *Variables) (bool, error) {
+	if !strings.Contains(expr, "{{") {
+		expr = "{{ " + expr + " }}"
+	}
+
+	t, err := template.New("when").Funcs(funcMap).Parse(expr)
+	if err != nil {
+		return false, err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return false, err
+	}
+
+	switch strings.TrimSpace(buf.String()) {
+	case "", "false", "0", "<no value>", "[]", "map[]":
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Type conditionFilter skips the repository files that don't match
+// their conditions and the content of such directories and absent ones.
+// Files must be passed in order of their FS paths (see walkLayers).
+type conditionFilter struct {
+	vars    *Variables
+	skipped []string
+	// Number of conditions that could not be evaluated
+	failed int
+}
+
+// Returns true if a given file must be skipped on the host.
+// A condition that cannot be evaluated skips the file too.
+func (cf *conditionFilter) Skip(rf *RepositoryFile) (bool, error) {
+	if len(cf.skipped) > 0 && underPaths(rf.FSPath, cf.skipped) {
+		return true, nil
+	}
+
+	if rf.State == StateAbsent {
+		cf.skipped = append(cf.skipped, rf.FSPath)
+	}
+
+	if rf.When.IsEmpty() {
+		return false, nil
+	}
+
+	ok, err := rf.When.Match(cf.vars)
+	if err != nil {
+		cf.failed++
+		err = fmt.Errorf("%s: when: %s", rf.FSPath, err)
+	}
+	if !ok {
+		cf.skipped = append(cf.skipped, rf.FSPath)
+	}
+
+	return !ok, err
+}
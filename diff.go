@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Number of unchanged lines around each change in unified diff.
+const diffContext = 3
+
+// Maximum number of changed lines in unified diff. The memory used by diffLines
+// grows as the square of this number, so larger differences are not shown.
+const diffMaxEdits = 2000
+
+type diffOp struct {
+	Kind byte // ' ', '-' or '+'
+	Line string
+}
+
+// Splits content into lines keeping the trailing newlines,
+// so a missing newline at the end of file is a difference too.
+func splitLines(content []byte) []string {
+	var lines []string
+
+	s := string(content)
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			lines = append(lines, s)
+			break
+		}
+		lines = append(lines, s[:i+1])
+		s = s[i+1:]
+	}
+
+	return lines
+}
+
+// Computes the shortest edit script that turns a into b (Myers' algorithm).
+// Returns false if it has more than maxEdits changes.
+func diffLines(a, b []string, maxEdits int) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max + 1
+
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	var x, y int
+
+loop:
+	for d := 0; d <= max; d++ {
+		if d > maxEdits {
+			return nil, false
+		}
+
+		// Saving only the meaningful part of v: k in [-d, d]
+		snap := make([]int, 2*d+1)
+		copy(snap, v[off-d:off+d+1])
+		trace = append(trace, snap)
+
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y = x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				break loop
+			}
+		}
+	}
+
+	// Backtracking
+	ops := make([]diffOp, 0, max)
+	x, y = n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		snap := trace[d]
+		get := func(k int) int { return snap[k+d] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		var prevX, prevY int
+		if d > 0 {
+			prevX = get(prevK)
+			prevY = prevX - prevK
+		}
+
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+
+	return ops, true
+}
+
+// Returns a unified diff between two contents or an empty string if they are equal.
+func unifiedDiff(oldContent, newContent []byte, oldName, newName string) string {
+	if bytes.Equal(oldContent, newContent) {
+		return ""
+	}
+
+	if bytes.IndexByte(oldContent, 0) >= 0 || bytes.IndexByte(newContent, 0) >= 0 {
+		return fmt.Sprintf("Binary files %s and %s differ\n", oldName, newName)
+	}
+
+	ops, ok := diffLines(splitLines(oldContent), splitLines(newContent), diffMaxEdits)
+	if !ok {
+		return fmt.Sprintf("Files %s and %s differ (too many changes to show)\n", oldName, newName)
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "--- %s\n", oldName)
+	fmt.Fprintf(&buf, "+++ %s\n", newName)
+
+	writeLine := func(kind byte, line string) {
+		buf.WriteByte(kind)
+		buf.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			buf.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+
+	// Positions of the ops in the old and new contents
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if op.Kind != '+' {
+			aPos[i+1]++
+		}
+		if op.Kind != '-' {
+			bPos[i+1]++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].Kind == ' ' {
+			i++
+			continue
+		}
+
+		// Hunk boundaries: changes separated by less than 2*diffContext
+		// unchanged lines are joined into one hunk
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].Kind != ' ' {
+				end = j
+				continue
+			}
+			if j-end > 2*diffContext {
+				break
+			}
+		}
+		stop := end + diffContext + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		aLen, bLen := aPos[stop]-aPos[start], bPos[stop]-bPos[start]
+		aStart, bStart := aPos[start], bPos[start]
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, op := range ops[start:stop] {
+			writeLine(op.Kind, op.Line)
+		}
+
+		i = stop
+	}
+
+	return buf.String()
+}
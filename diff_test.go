@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	got := unifiedDiff([]byte("a\nb\nc\n"), []byte("a\nB\nc"), "old", "new")
+	want := "--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n-c\n+B\n+c\n\\ No newline at end of file\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUnifiedDiffLarge(t *testing.T) {
+	var a, b, c strings.Builder
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(&a, "line %d\n", i)
+		fmt.Fprintf(&b, "other %d\n", i)
+		if i == 25000 {
+			c.WriteString("changed\n")
+		} else {
+			fmt.Fprintf(&c, "line %d\n", i)
+		}
+	}
+
+	// A small change in a large file is shown
+	got := unifiedDiff([]byte(a.String()), []byte(c.String()), "old", "new")
+	if !strings.Contains(got, "@@ -24998,7 +24998,7 @@\n") || !strings.Contains(got, "-line 25000\n+changed\n") {
+		t.Errorf("unexpected diff: %q", got)
+	}
+
+	// Too many changes are not shown
+	got = unifiedDiff([]byte(a.String()), []byte(b.String()), "old", "new")
+	if want := "Files old and new differ (too many changes to show)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
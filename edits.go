@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Repository files with these suffixes manage only a part of the file
+// in the file system, the rest of its content is left as is:
+//
+//	FILENAME.block        the content between BEGIN/END markers (see RepositoryFile.Marker)
+//	FILENAME.lines        YAML list of lines that must be present or absent (see lineRule)
+//	NAME.merge.EXT        keys that are deep merged into NAME.EXT (see mergeDocument),
+//	                      EXT is yaml, yml, json or ini
+//
+// All of them can be templates too: FILENAME.block.template.
+const (
+	EditBlock = "block"
+	EditLines = "lines"
+	EditMerge = "merge"
+)
+
+const defaultMarker = "# {mark} keeper"
+
+// Returns the edit kind of a repository path (without the .template suffix)
+// and the path without the edit suffix. The kind is an empty string
+// if the file replaces the whole file in the file system.
+func editKind(repopath string) (string, string) {
+	ext := path.Ext(repopath)
+
+	switch ext {
+	case "." + EditBlock, "." + EditLines:
+		return ext[1:], strings.TrimSuffix(repopath, ext)
+	case ".yaml", ".yml", ".json", ".ini":
+		if base := strings.TrimSuffix(repopath, ext); path.Ext(base) == "."+EditMerge {
+			return EditMerge, strings.TrimSuffix(base, "."+EditMerge) + ext
+		}
+	}
+
+	return "", repopath
+}
+
+// Type lineRule is a single rule of the .lines file:
+//
+//   - line: net.ipv4.ip_forward = 1
+//     regexp: '^\s*net\.ipv4\.ip_forward\s*='
+//   - regexp: '^kernel\.panic\s*='
+//     state: absent
+//
+// If the line is present, the first line matching the regexp or equal to the line
+// is replaced with it and other matching lines are removed. The line is appended
+// to the end if nothing matches. If the state is absent, all lines matching
+// the regexp are removed. Without a regexp the lines equal to a given line are matched.
+type lineRule struct {
+	Line   string `yaml:"line"`
+	Regexp string `yaml:"regexp"`
+	State  string `yaml:"state"` // present (default) or absent
+}
+
+// Applies the repository content src to the current content of the file
+// in the file system and returns the resulting content.
+func (rf *RepositoryFile) applyEdit(current, src []byte) ([]byte, error) {
+	switch rf.Edit {
+	case EditBlock:
+		marker := rf.Marker
+		if marker == "" {
+			marker = defaultMarker
+		}
+		return editBlock(current, src, marker)
+	case EditLines:
+		var rules []lineRule
+		if err := yaml.Unmarshal(src, &rules); err != nil {
+			return nil, fmt.Errorf("%s: %s", rf.Path, err)
+		}
+		return editLines(current, rules)
+	case EditMerge:
+		return mergeDocument(path.Ext(rf.FSPath), current, src)
+	}
+	return src, nil
+}
+
+// Replaces the content between the BEGIN and END markers with the block
+// or appends the block with markers to the end of the content.
+func editBlock(current, block []byte, marker string) ([]byte, error) {
+	begin := strings.Replace(marker, "{mark}", "BEGIN", -1)
+	end := strings.Replace(marker, "{mark}", "END", -1)
+
+	lines := strings.Split(string(current), "\n")
+
+	first, last := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case begin:
+			if first < 0 {
+				first = i
+			}
+		case end:
+			if first >= 0 && last < 0 {
+				last = i
+			}
+		}
+	}
+	if first >= 0 && last < 0 {
+		return nil, fmt.Errorf("no %q marker after %q", end, begin)
+	}
+
+	var buf bytes.Buffer
+
+	if first < 0 {
+		buf.Write(current)
+		if len(current) > 0 && !bytes.HasSuffix(current, []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+	} else {
+		buf.WriteString(strings.Join(lines[:first], "\n"))
+		if first > 0 {
+			buf.WriteByte('\n')
+		}
+	}
+
+	buf.WriteString(begin + "\n")
+	buf.Write(block)
+	if len(block) > 0 && !bytes.HasSuffix(block, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(end + "\n")
+
+	if first >= 0 {
+		buf.WriteString(strings.Join(lines[last+1:], "\n"))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Applies the rules to the content line by line.
+func editLines(current []byte, rules []lineRule) ([]byte, error) {
+	lines := strings.Split(string(current), "\n")
+
+	// The last element is empty if the content ends with a newline
+	if n := len(lines); lines[n-1] == "" {
+		lines = lines[:n-1]
+	}
+
+	for _, r := range rules {
+		var absent bool
+		switch r.State {
+		case "", "present":
+		case "absent":
+			absent = true
+		default:
+			return nil, fmt.Errorf("incorrect state of line %q: %s", r.Line, r.State)
+		}
+
+		match := func(s string) bool { return s == r.Line }
+		if r.Regexp != "" {
+			re, err := regexp.Compile(r.Regexp)
+			if err != nil {
+				return nil, err
+			}
+			match = re.MatchString
+			if !absent {
+				// The line itself matches even if it doesn't match the regexp,
+				// otherwise it would be appended again on each run
+				match = func(s string) bool { return s == r.Line || re.MatchString(s) }
+			}
+		}
+		if !absent && strings.Contains(r.Line, "\n") {
+			return nil, fmt.Errorf("line must not contain newlines: %q", r.Line)
+		}
+
+		found := false
+		res := lines[:0:0]
+		for _, line := range lines {
+			switch {
+			case !match(line):
+				res = append(res, line)
+			case !absent && !found:
+				res = append(res, r.Line)
+				found = true
+			}
+		}
+		if !absent && !found {
+			res = append(res, r.Line)
+		}
+		lines = res
+	}
+
+	if len(lines) == 0 {
+		return []byte{}, nil
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
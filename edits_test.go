@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEditLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		rules   []lineRule
+		want    string
+	}{
+		{
+			name:    "replace by regexp",
+			current: "a=1\nb = 2\nb=3\n",
+			rules:   []lineRule{{Line: "b = 9", Regexp: `^b\s*=`}},
+			want:    "a=1\nb = 9\n",
+		},
+		{
+			name:    "append if nothing matches",
+			current: "a=1",
+			rules:   []lineRule{{Line: "c=1"}},
+			want:    "a=1\nc=1\n",
+		},
+		{
+			name:    "line that doesn't match its regexp",
+			current: "foo=1\n",
+			rules:   []lineRule{{Line: "bar=1", Regexp: "^foo"}},
+			want:    "bar=1\n",
+		},
+		{
+			name:    "remove by regexp",
+			current: "kernel.panic=5\na=1\nkernel.panic = 1\n",
+			rules:   []lineRule{{Regexp: `^kernel\.panic`, State: "absent"}},
+			want:    "a=1\n",
+		},
+		{
+			name:    "remove exact line",
+			current: "a=1\nb=2\n",
+			rules:   []lineRule{{Line: "b=2", State: "absent"}},
+			want:    "a=1\n",
+		},
+		{
+			name:    "empty file",
+			current: "",
+			rules:   []lineRule{{Line: "a=1"}},
+			want:    "a=1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := editLines([]byte(tt.current), tt.rules)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		// Applying the rules again changes nothing
+		if again, _ := editLines(got, tt.rules); string(again) != string(got) {
+			t.Errorf("%s: second run changed the content: %q", tt.name, again)
+		}
+	}
+}
+
+func TestEditBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		block   string
+		want    string
+	}{
+		{
+			name:    "append",
+			current: "127.0.0.1 localhost",
+			block:   "10.0.0.1 a",
+			want:    "127.0.0.1 localhost\n# BEGIN keeper\n10.0.0.1 a\n# END keeper\n",
+		},
+		{
+			name:    "replace",
+			current: "x\n# BEGIN keeper\nold\n# END keeper\ny\n",
+			block:   "new\n",
+			want:    "x\n# BEGIN keeper\nnew\n# END keeper\ny\n",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := editBlock([]byte(tt.current), []byte(tt.block), defaultMarker)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := editBlock([]byte("# BEGIN keeper\nx\n"), []byte("y"), defaultMarker); err == nil {
+		t.Errorf("no error for a missing END marker")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type Facts describes the host's system parameters.
+type Facts struct {
+	FQDN   string
+	Domain string
+	// Key/value pairs from /etc/os-release, e.g. ID, VERSION_ID, PRETTY_NAME
+	OS       map[string]string
+	Kernel   string
+	CPUs     int
+	MemTotal uint64 // in bytes
+	// Default gateways and their interfaces
+	Gateway4      string
+	Gateway4Iface string
+	Gateway6      string
+	Gateway6Iface string
+	Mounts        []Mount
+}
+
+// Type Mount represents a mounted filesystem.
+type Mount struct {
+	Device     string
+	Mountpoint string
+	FSType     string
+	Options    []string
+}
+
+// Files the facts are gathered from, in the order expected by parseFacts.
+var factFiles = []string{
+	"/etc/os-release",
+	"/proc/sys/kernel/osrelease",
+	"/proc/meminfo",
+	"/proc/mounts",
+	"/proc/net/route",
+	"/proc/net/ipv6_route",
+}
+
+// Returns the facts of the local host.
+func getFacts(hostname string) (*Facts, error) {
+	files := make([][]byte, len(factFiles))
+
+	for i, fname := range factFiles {
+		switch b, err := ioutil.ReadFile(fname); {
+		case err == nil:
+			files[i] = b
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+
+	return parseFacts(lookupFQDN(hostname), runtime.NumCPU(), files), nil
+}
+
+// Makes the facts from the content of factFiles.
+func parseFacts(fqdn string, cpus int, files [][]byte) *Facts {
+	f := Facts{
+		FQDN:     fqdn,
+		Domain:   fqdnDomain(fqdn),
+		OS:       parseOSRelease(files[0]),
+		Kernel:   strings.TrimSpace(string(files[1])),
+		CPUs:     cpus,
+		MemTotal: parseMemTotal(files[2]),
+		Mounts:   parseMounts(files[3]),
+	}
+
+	f.Gateway4, f.Gateway4Iface = parseRoute4(files[4])
+	f.Gateway6, f.Gateway6Iface = parseRoute6(files[5])
+
+	return &f
+}
+
+// Time limit of the FQDN lookup, so an unavailable DNS doesn't stall the commands.
+const fqdnLookupTimeout = 2 * time.Second
+
+// Returns the fully qualified domain name of the host
+// or the hostname itself if it cannot be resolved.
+func lookupFQDN(hostname string) string {
+	if strings.Contains(hostname, ".") {
+		return hostname
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fqdnLookupTimeout)
+	defer cancel()
+
+	if cname, err := net.DefaultResolver.LookupCNAME(ctx, hostname); err == nil {
+		if name := strings.TrimSuffix(cname, "."); strings.Contains(name, ".") {
+			return name
+		}
+	}
+	return hostname
+}
+
+// Returns the domain part of a given FQDN.
+func fqdnDomain(fqdn string) string {
+	if i := strings.Index(fqdn, "."); i > 0 {
+		return fqdn[i+1:]
+	}
+	return ""
+}
+
+// Parses the content of /etc/os-release.
+func parseOSRelease(b []byte) map[string]string {
+	res := make(map[string]string)
+
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		value := fields[1]
+		if v, err := strconv.Unquote(value); err == nil {
+			value = v
+		} else {
+			value = strings.Trim(value, `"'`)
+		}
+		res[fields[0]] = value
+	}
+
+	return res
+}
+
+// Parses the content of /proc/meminfo and returns the total memory in bytes.
+func parseMemTotal(b []byte) uint64 {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			v, _ := strconv.ParseUint(fields[1], 10, 64)
+			return v * 1024
+		}
+	}
+	return 0
+}
+
+// Parses the content of /proc/mounts.
+func parseMounts(b []byte) []Mount {
+	// Special characters are encoded as octal sequences, e.g. "\040" is a space
+	unescape := func(s string) string {
+		if !strings.Contains(s, `\`) {
+			return s
+		}
+		var buf strings.Builder
+		for i := 0; i < len(s); i++ {
+			if s[i] == '\\' && i+4 <= len(s) {
+				if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+					buf.WriteByte(byte(v))
+					i += 3
+					continue
+				}
+			}
+			buf.WriteByte(s[i])
+		}
+		return buf.String()
+	}
+
+	mounts := []Mount{}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		mounts = append(mounts, Mount{
+			Device:     unescape(fields[0]),
+			Mountpoint: unescape(fields[1]),
+			FSType:     fields[2],
+			Options:    strings.Split(fields[3], ","),
+		})
+	}
+
+	return mounts
+}
+
+// Parses the content of /proc/net/route and returns
+// the default IPv4 gateway and its interface.
+func parseRoute4(b []byte) (string, string) {
+	for _, line := range strings.Split(string(b), "\n") {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" || fields[2] == "00000000" {
+			continue
+		}
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil || len(gw) != 4 {
+			continue
+		}
+		// The address is in the host (little-endian) byte order
+		return net.IPv4(gw[3], gw[2], gw[1], gw[0]).String(), fields[0]
+	}
+	return "", ""
+}
+
+// Parses the content of /proc/net/ipv6_route and returns
+// the default IPv6 gateway and its interface.
+func parseRoute6(b []byte) (string, string) {
+	zero := strings.Repeat("0", 32)
+
+	for _, line := range strings.Split(string(b), "\n") {
+		// Destination DstPrefixLen Source SrcPrefixLen Gateway Metric RefCnt Use Flags Iface
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[0] != zero || fields[1] != "00" || fields[4] == zero {
+			continue
+		}
+		gw, err := hex.DecodeString(fields[4])
+		if err != nil || len(gw) != net.IPv6len {
+			continue
+		}
+		return net.IP(gw).String(), fields[9]
+	}
+	return "", ""
+}
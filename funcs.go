@@ -0,0 +1,439 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Sprig-like functions that are available in templates in addition to funcMap.
+// The argument order allows pipelines: {{ .X.servers | join "," }}.
+var libraryFuncs = map[string]interface{}{
+	// Strings
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      strings.Title,
+	"trim":       strings.TrimSpace,
+	"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"repeat":     func(n int, s string) string { return strings.Repeat(s, n) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"trunc":      trunc,
+	"join":       joinList,
+	"indent":     indent,
+	"nindent":    func(n int, s string) string { return "\n" + indent(n, s) },
+	"quote":      func(v interface{}) string { return strconv.Quote(toString(v)) },
+	"squote":     func(v interface{}) string { return "'" + toString(v) + "'" },
+	"toString":   toString,
+
+	// Defaults and conditions
+	"default":  defaultValue,
+	"empty":    isEmpty,
+	"coalesce": coalesce,
+	"ternary": func(vt, vf interface{}, cond bool) interface{} {
+		if cond {
+			return vt
+		}
+		return vf
+	},
+
+	// Lists
+	"list":      func(v ...interface{}) []interface{} { return v },
+	"first":     firstItem,
+	"last":      lastItem,
+	"has":       hasItem,
+	"uniq":      uniqList,
+	"sortAlpha": sortAlpha,
+
+	// Dictionaries
+	"dict":   dict,
+	"keys":   keys,
+	"hasKey": hasKey,
+	"get":    getKey,
+
+	// Encoding and hashing
+	"toJson":       toJSON,
+	"toPrettyJson": toPrettyJSON,
+	"toYaml":       toYAML,
+	"b64enc":       func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64dec":       b64dec,
+	"sha1sum":      func(s string) string { h := sha1.Sum([]byte(s)); return hex.EncodeToString(h[:]) },
+	"sha256sum":    func(s string) string { h := sha256.Sum256([]byte(s)); return hex.EncodeToString(h[:]) },
+
+	// Arithmetic
+	"atoi":  func(s string) (int, error) { return strconv.Atoi(strings.TrimSpace(s)) },
+	"int":   toInt,
+	"add":   func(a, b interface{}) (int64, error) { return arith(a, b, func(x, y int64) int64 { return x + y }) },
+	"sub":   func(a, b interface{}) (int64, error) { return arith(a, b, func(x, y int64) int64 { return x - y }) },
+	"mul":   func(a, b interface{}) (int64, error) { return arith(a, b, func(x, y int64) int64 { return x * y }) },
+	"div":   divide,
+	"mod":   modulo,
+	"max":   func(a, b interface{}) (int64, error) { return arith(a, b, maxInt64) },
+	"min":   func(a, b interface{}) (int64, error) { return arith(a, b, minInt64) },
+	"seq":   seq,
+	"until": func(n int) []int { return seq(0, n-1) },
+}
+
+func init() {
+	for name, fn := range libraryFuncs {
+		funcMap[name] = fn
+	}
+}
+
+// Converts a value to a string. Nil is an empty string.
+func toString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// Converts a list of any type to a list of interface{} values.
+func toList(v interface{}) ([]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if l, ok := v.([]interface{}); ok {
+		return l, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("not a list: %T", v)
+	}
+
+	l := make([]interface{}, rv.Len())
+	for i := range l {
+		l[i] = rv.Index(i).Interface()
+	}
+
+	return l, nil
+}
+
+// Joins the list items converted to strings.
+func joinList(sep string, v interface{}) (string, error) {
+	l, err := toList(v)
+	if err != nil {
+		return "", err
+	}
+
+	items := make([]string, 0, len(l))
+	for _, x := range l {
+		items = append(items, toString(x))
+	}
+
+	return strings.Join(items, sep), nil
+}
+
+// Returns the first n bytes of s or the last -n bytes if n is negative.
+func trunc(n int, s string) string {
+	switch {
+	case n >= 0 && n < len(s):
+		return s[:n]
+	case n < 0 && -n < len(s):
+		return s[len(s)+n:]
+	}
+	return s
+}
+
+// Indents each line of s with n spaces.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+// Checks whether the value is nil or the zero value of its type,
+// or an empty string, list or dictionary.
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	rv := reflect.ValueOf(v)
+
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+
+	return rv.IsZero()
+}
+
+// Returns the given value or def if the value is empty. Templates fail on missing keys,
+// so optional ones are taken with get: {{ get .X "port" | default 80 }}.
+func defaultValue(def interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || isEmpty(given[0]) {
+		return def
+	}
+	return given[0]
+}
+
+// Returns the first non-empty value.
+func coalesce(v ...interface{}) interface{} {
+	for _, x := range v {
+		if !isEmpty(x) {
+			return x
+		}
+	}
+	return nil
+}
+
+func firstItem(v interface{}) (interface{}, error) {
+	l, err := toList(v)
+	if err != nil || len(l) == 0 {
+		return nil, err
+	}
+	return l[0], nil
+}
+
+func lastItem(v interface{}) (interface{}, error) {
+	l, err := toList(v)
+	if err != nil || len(l) == 0 {
+		return nil, err
+	}
+	return l[len(l)-1], nil
+}
+
+// Checks whether the list contains a given item.
+func hasItem(item, v interface{}) (bool, error) {
+	l, err := toList(v)
+	if err != nil {
+		return false, err
+	}
+	for _, x := range l {
+		if reflect.DeepEqual(x, item) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns the list without duplicates, the order is preserved.
+func uniqList(v interface{}) ([]interface{}, error) {
+	l, err := toList(v)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []interface{}{}
+	for _, x := range l {
+		found := false
+		for _, y := range res {
+			if reflect.DeepEqual(x, y) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, x)
+		}
+	}
+
+	return res, nil
+}
+
+// Returns the list items converted to strings and sorted alphabetically.
+func sortAlpha(v interface{}) ([]string, error) {
+	l, err := toList(v)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(l))
+	for _, x := range l {
+		res = append(res, toString(x))
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+// Makes a dictionary from key/value pairs: {{ dict "name" "eth0" "mtu" 1500 }}.
+func dict(v ...interface{}) (map[string]interface{}, error) {
+	if len(v)%2 != 0 {
+		return nil, fmt.Errorf("dict requires an even number of arguments")
+	}
+
+	d := make(map[string]interface{}, len(v)/2)
+	for i := 0; i < len(v); i += 2 {
+		d[toString(v[i])] = v[i+1]
+	}
+
+	return d, nil
+}
+
+// Returns the sorted keys of a dictionary.
+func keys(v interface{}) ([]string, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map {
+		return nil, fmt.Errorf("not a dictionary: %T", v)
+	}
+
+	res := make([]string, 0, rv.Len())
+	for _, k := range rv.MapKeys() {
+		res = append(res, toString(k.Interface()))
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+// Returns the value of a given key of a dictionary with any value type
+// (e.g. .Labels or .Facts.OS) and false if there is no such key.
+func mapIndex(d interface{}, key string) (interface{}, bool, error) {
+	rv := reflect.ValueOf(d)
+	if rv.Kind() != reflect.Map {
+		return nil, false, fmt.Errorf("not a dictionary: %T", d)
+	}
+
+	kv := reflect.ValueOf(key)
+	switch kt := rv.Type().Key(); {
+	case kv.Type().AssignableTo(kt):
+	case kt.Kind() == reflect.String:
+		kv = kv.Convert(kt)
+	default:
+		return nil, false, fmt.Errorf("not a dictionary with string keys: %T", d)
+	}
+
+	v := rv.MapIndex(kv)
+	if !v.IsValid() {
+		return nil, false, nil
+	}
+
+	return v.Interface(), true, nil
+}
+
+func hasKey(d interface{}, key string) (bool, error) {
+	_, ok, err := mapIndex(d, key)
+	return ok, err
+}
+
+// Returns the value of a given key or nil if there is no such key.
+func getKey(d interface{}, key string) (interface{}, error) {
+	v, _, err := mapIndex(d, key)
+	return v, err
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func toPrettyJSON(v interface{}) (string, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	return string(b), err
+}
+
+// Returns the YAML representation of a value without the trailing newline.
+func toYAML(v interface{}) (string, error) {
+	b, err := yaml.Marshal(v)
+	return strings.TrimSuffix(string(b), "\n"), err
+}
+
+func b64dec(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+// Converts a number or a numeric string to int64.
+// JSON numbers (float64) must be integral.
+func toInt64(v interface{}) (int64, error) {
+	rv := reflect.ValueOf(v)
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f != math.Trunc(f) {
+			return 0, fmt.Errorf("not an integer: %v", f)
+		}
+		return int64(f), nil
+	case reflect.String:
+		return strconv.ParseInt(strings.TrimSpace(rv.String()), 10, 64)
+	}
+
+	return 0, fmt.Errorf("not a number: %v", v)
+}
+
+func toInt(v interface{}) (int, error) {
+	n, err := toInt64(v)
+	return int(n), err
+}
+
+func arith(a, b interface{}, fn func(x, y int64) int64) (int64, error) {
+	x, err := toInt64(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := toInt64(b)
+	if err != nil {
+		return 0, err
+	}
+	return fn(x, y), nil
+}
+
+func divide(a, b interface{}) (int64, error) {
+	if y, err := toInt64(b); err == nil && y == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+	return arith(a, b, func(x, y int64) int64 { return x / y })
+}
+
+func modulo(a, b interface{}) (int64, error) {
+	if y, err := toInt64(b); err == nil && y == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+	return arith(a, b, func(x, y int64) int64 { return x % y })
+}
+
+func maxInt64(x, y int64) int64 {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+func minInt64(x, y int64) int64 {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+// Returns the integers from start to end inclusive.
+func seq(start, end int) []int {
+	res := []int{}
+	for i := start; i <= end; i++ {
+		res = append(res, i)
+	}
+	return res
+}
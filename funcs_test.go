@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"text/template"
+)
+
+// Executes a template text the same way as repository templates.
+func executeText(text string, data interface{}) (string, error) {
+	t, err := template.New("test").Option("missingkey=error").Funcs(funcMap).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+var funcsTestData = map[string]interface{}{
+	"X": CustomVariables{
+		"port":    8080,
+		"name":    "",
+		"servers": []interface{}{"b", "a", "b"},
+		"nested":  map[string]interface{}{"key": "value"},
+	},
+	"Labels": map[string]string{"role": "web", "dc": "ams"},
+	"Ports":  []int{80, 443},
+}
+
+func TestLibraryFuncs(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		// Strings
+		{`{{ "abc" | upper }}`, "ABC"},
+		{`{{ "ABC" | lower }}`, "abc"},
+		{`{{ "hello world" | title }}`, "Hello World"},
+		{`{{ "  x  " | trim }}`, "x"},
+		{`{{ "--x--" | trimAll "-" }}`, "x"},
+		{`{{ "www.example.com" | trimPrefix "www." }}`, "example.com"},
+		{`{{ "file.conf" | trimSuffix ".conf" }}`, "file"},
+		{`{{ "foobar" | contains "oba" }}`, "true"},
+		{`{{ "foobar" | hasPrefix "foo" }}`, "true"},
+		{`{{ "foobar" | hasSuffix "foo" }}`, "false"},
+		{`{{ "a.b.c" | replace "." "_" }}`, "a_b_c"},
+		{`{{ "ab" | repeat 3 }}`, "ababab"},
+		{`{{ "a,b" | split "," | join ";" }}`, "a;b"},
+		{`{{ "abcdef" | trunc 3 }}`, "abc"},
+		{`{{ "abcdef" | trunc -2 }}`, "ef"},
+		{`{{ "abc" | trunc 10 }}`, "abc"},
+		{`{{ .X.servers | join "," }}`, "b,a,b"},
+		{`{{ .Ports | join " " }}`, "80 443"},
+		{`{{ "a\nb" | indent 2 }}`, "  a\n  b"},
+		{`{{ "a" | nindent 2 }}`, "\n  a"},
+		{`{{ "a\"b" | quote }}`, `"a\"b"`},
+		{`{{ 5 | squote }}`, "'5'"},
+		{`{{ .X.port | toString }}`, "8080"},
+
+		// Defaults and conditions
+		{`{{ .X.name | default "none" }}`, "none"},
+		{`{{ .X.port | default 80 }}`, "8080"},
+		{`{{ get .X "missing" | default 80 }}`, "80"},
+		{`{{ empty .X.name }} {{ empty .X.servers }} {{ empty 0 }}`, "true false true"},
+		{`{{ coalesce .X.name "" "x" }}`, "x"},
+		{`{{ ternary "yes" "no" true }} {{ ternary "yes" "no" false }}`, "yes no"},
+
+		// Lists
+		{`{{ list 1 "a" | toJson }}`, `[1,"a"]`},
+		{`{{ first .X.servers }} {{ last .Ports }}`, "b 443"},
+		{`{{ .X.servers | has "a" }} {{ .X.servers | has "c" }}`, "true false"},
+		{`{{ .X.servers | uniq | join "," }}`, "b,a"},
+		{`{{ .X.servers | sortAlpha | join "," }}`, "a,b,b"},
+
+		// Dictionaries
+		{`{{ dict "a" 1 "b" 2 | toJson }}`, `{"a":1,"b":2}`},
+		{`{{ keys .Labels | join "," }}`, "dc,role"},
+		{`{{ hasKey .X "port" }} {{ hasKey .X "missing" }}`, "true false"},
+		{`{{ hasKey .Labels "role" }} {{ hasKey .Labels "missing" }}`, "true false"},
+		{`{{ get .Labels "role" }}`, "web"},
+		{`{{ get .X.nested "key" }}`, "value"},
+		{`{{ get .Labels "missing" | default "none" }}`, "none"},
+
+		// Encoding and hashing
+		{`{{ .Labels | toJson }}`, `{"dc":"ams","role":"web"}`},
+		{`{{ .X.nested | toPrettyJson }}`, "{\n  \"key\": \"value\"\n}"},
+		{`{{ .X.nested | toYaml }}`, "key: value"},
+		{`{{ "hello" | b64enc }}`, "aGVsbG8="},
+		{`{{ "aGVsbG8=" | b64dec }}`, "hello"},
+		{`{{ "abc" | sha1sum }}`, "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{`{{ "abc" | sha256sum }}`, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+
+		// Arithmetic
+		{`{{ atoi " 42 " }}`, "42"},
+		{`{{ int "7" }} {{ int 7.0 }}`, "7 7"},
+		{`{{ add .X.port 1 }} {{ sub 10 "3" }} {{ mul 4 5 }}`, "8081 7 20"},
+		{`{{ div 7 2 }} {{ mod 7 2 }}`, "3 1"},
+		{`{{ max 3 9 }} {{ min 3 9 }}`, "9 3"},
+		{`{{ seq 1 3 }} {{ until 3 }} {{ seq 3 1 }}`, "[1 2 3] [0 1 2] []"},
+	}
+
+	for _, tt := range tests {
+		got, err := executeText(tt.text, funcsTestData)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.text, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLibraryFuncsErrors(t *testing.T) {
+	tests := []string{
+		`{{ .X.missing | default 80 }}`,
+		`{{ join "," "abc" }}`,
+		`{{ keys "abc" }}`,
+		`{{ hasKey .Ports "a" }}`,
+		`{{ get "abc" "a" }}`,
+		`{{ dict "a" }}`,
+		`{{ b64dec "%%%" }}`,
+		`{{ atoi "x" }}`,
+		`{{ int 1.5 }}`,
+		`{{ add "x" 1 }}`,
+		`{{ div 1 0 }}`,
+		`{{ mod 1 0 }}`,
+	}
+
+	for _, text := range tests {
+		if got, err := executeText(text, funcsTestData); err == nil {
+			t.Errorf("%s: expected an error, got %q", text, got)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// on_change commands of repository directories
+	dirHooks = make(DirHooks)
+	// Commands that will be run at the end of sync, in order of appearance
+	pendingHooks []string
+)
+
+// Type Commands is a list of shell commands.
+// In YAML it can be defined as a single string or as a list of strings.
+type Commands []string
+
+func (c *Commands) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*c = Commands{s}
+		return nil
+	}
+
+	var l []string
+	if err := unmarshal(&l); err != nil {
+		return err
+	}
+	*c = l
+
+	return nil
+}
+
+// Type DirHooks maps the file system paths of repository directories
+// to their on_change commands.
+type DirHooks map[string]Commands
+
+// Remembers the on_change commands of a repository directory,
+// so they can be scheduled when anything below this directory changes.
+func (dh DirHooks) Register(rf *RepositoryFile) {
+	if rf.Mode.IsDir() && len(rf.OnChange) > 0 {
+		dh[rf.FSPath] = rf.OnChange
+	}
+}
+
+// Appends the on_change commands of a changed file and of all its parent
+// directories to the list, skipping the commands that are already there.
+func (dh DirHooks) Collect(rf *RepositoryFile, hooks []string) []string {
+	add := func(cmds Commands) {
+		for _, cmd := range cmds {
+			cmd = strings.TrimSpace(cmd)
+			if cmd == "" {
+				continue
+			}
+			found := false
+			for _, x := range hooks {
+				if x == cmd {
+					found = true
+					break
+				}
+			}
+			if !found {
+				hooks = append(hooks, cmd)
+			}
+		}
+	}
+
+	add(rf.OnChange)
+
+	// Directories are looked up by the file system paths,
+	// so they can be supplied by any layer
+	for d := filepath.Dir(rf.FSPath); d != "/"; d = filepath.Dir(d) {
+		add(dh[d])
+	}
+
+	return hooks
+}
+
+// Schedules the on_change commands of a changed file and of all
+// its parent directories. Each unique command is scheduled only once.
+func scheduleHooks(rf *RepositoryFile) {
+	pendingHooks = dirHooks.Collect(rf, pendingHooks)
+}
+
+// Runs the scheduled on_change commands one by one.
+// A failed command doesn't prevent the rest from running.
+func runHooks() error {
+	if len(pendingHooks) == 0 {
+		return nil
+	}
+
+	textln()
+	textln("--> Running on_change commands:")
+
+	var failed int
+
+	for _, cmd := range pendingHooks {
+		textf(" $ %s\n", cmd)
+
+		ev := SyncEvent{Action: "hook", Command: cmd, Dryrun: DRYRUN}
+
+		if !DRYRUN {
+			c := exec.Command("/bin/sh", "-c", cmd)
+			c.Stdout = os.Stdout
+			c.Stderr = os.Stderr
+			// Keeping the standard output clean for JSON events
+			if JSON_OUTPUT {
+				c.Stdout = os.Stderr
+			}
+
+			if err := c.Run(); err != nil {
+				warn(fmt.Sprintf("%q: %s", cmd, err))
+				ev.Error = err.Error()
+				failed++
+			}
+		}
+
+		if JSON_OUTPUT {
+			emitEvent(&ev)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d on_change commands failed", failed, len(pendingHooks))
+	}
+
+	return nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Type InventoryHost describes a host defined in the inventory file.
+type InventoryHost struct {
+	Address string            `yaml:"address"`
+	User    string            `yaml:"user"`
+	Port    int               `yaml:"port"`
+	Labels  map[string]string `yaml:"labels"`
+
+	Name  string      `yaml:"-"`
+	Agent RemoteAgent `yaml:"-"`
+}
+
+// Type Inventory describes the hosts managed by Keeper and their groups.
+// Each group is a list of selectors (see Inventory.Select).
+type Inventory struct {
+	Defaults struct {
+		User string `yaml:"user"`
+		Port int    `yaml:"port"`
+	} `yaml:"defaults"`
+	Hosts  map[string]*InventoryHost `yaml:"hosts"`
+	Groups map[string][]string       `yaml:"groups"`
+
+	// All hosts: sorted inventory hosts and then ./agents output
+	list []*InventoryHost
+}
+
+// Returns the path of the inventory file: inventory.yaml at the root
+// of repository or in the KEEPER_SYSDIR. Returns an empty string if none exists.
+func inventoryFile() string {
+	for _, fname := range []string{"inventory.yaml", path.Join(KEEPER_SYSDIR, "inventory.yaml")} {
+		if _, err := os.Stat(fname); err == nil {
+			return fname
+		}
+	}
+	return ""
+}
+
+// Loads only the inventory file (if exists) without running ./agents.
+func loadStaticInventory() (*Inventory, error) {
+	inv := new(Inventory)
+
+	if fname := inventoryFile(); fname != "" {
+		c, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(c, inv); err != nil {
+			return nil, fmt.Errorf("%s: %s", fname, err)
+		}
+	}
+
+	names := make([]string, 0, len(inv.Hosts))
+	for name := range inv.Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h := inv.Hosts[name]
+		if h == nil {
+			h = new(InventoryHost)
+			inv.Hosts[name] = h
+		}
+
+		addr := name
+		if h.Address != "" {
+			addr = h.Address
+		}
+		a, err := parseRemoteAgent(addr)
+		if err != nil {
+			return nil, fmt.Errorf("inventory host %s: %s", name, err)
+		}
+		if !strings.Contains(addr, "@") && inv.Defaults.User != "" {
+			a.User = inv.Defaults.User
+		}
+		if !strings.Contains(addr, ":") && inv.Defaults.Port != 0 {
+			a.Port = inv.Defaults.Port
+		}
+		if h.User != "" {
+			a.User = h.User
+		}
+		if h.Port != 0 {
+			a.Port = h.Port
+		}
+
+		h.Name = name
+		h.Agent = *a
+
+		inv.list = append(inv.list, h)
+	}
+
+	return inv, nil
+}
+
+// Appends the hosts from the output of ./agents executable (if exists)
+// that are not defined in the inventory file.
+func (inv *Inventory) loadAgents() error {
+	switch out, err := exec.Command("./agents").Output(); {
+	case err == nil:
+		for _, s := range strings.Fields(string(out)) {
+			a, err := parseRemoteAgent(s)
+			if err != nil {
+				return fmt.Errorf("./agents: %s", err)
+			}
+			if inv.lookup(a.Host) == nil {
+				inv.list = append(inv.list, &InventoryHost{Name: a.Host, Agent: *a})
+			}
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("%s: %s", err, out)
+	}
+
+	return nil
+}
+
+// Returns the host with a given name or address.
+func (inv *Inventory) lookup(name string) *InventoryHost {
+	for _, h := range inv.list {
+		if h.Name == name || h.Agent.Host == name || h.Agent.String() == name {
+			return h
+		}
+	}
+	return nil
+}
+
+// Checks whether the host's labels satisfy an expression like "dc=ams,role!=db".
+// Values can be glob patterns.
+func (h *InventoryHost) matchLabels(expr string) (bool, error) {
+	for _, cond := range strings.Split(expr, ",") {
+		negative := false
+
+		fields := strings.SplitN(cond, "!=", 2)
+		switch {
+		case len(fields) == 2:
+			negative = true
+		default:
+			fields = strings.SplitN(cond, "=", 2)
+			if len(fields) != 2 {
+				return false, fmt.Errorf("incorrect label selector: %s", cond)
+			}
+		}
+
+		key, pattern := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+
+		value, ok := h.Labels[key]
+		matched, err := path.Match(pattern, value)
+		if err != nil {
+			return false, err
+		}
+		if (ok && matched) == negative {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Returns the hosts matching a single selector. Visited groups are stored
+// in seen to prevent the infinite recursion.
+func (inv *Inventory) match(sel string, seen StringSet) ([]*InventoryHost, error) {
+	switch {
+	case sel == "all" || sel == "@all":
+		return inv.list, nil
+	case strings.HasPrefix(sel, "@"):
+		name := sel[1:]
+		members, ok := inv.Groups[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown group: %s", name)
+		}
+		if seen.Has(name) {
+			return nil, fmt.Errorf("group %s includes itself", name)
+		}
+		seen.Add(name)
+		defer seen.Remove(name)
+		return inv.selectAll(members, seen)
+	case strings.Contains(sel, "="):
+		var hosts []*InventoryHost
+		for _, h := range inv.list {
+			ok, err := h.matchLabels(sel)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				hosts = append(hosts, h)
+			}
+		}
+		return hosts, nil
+	case strings.ContainsAny(sel, "*?["):
+		var hosts []*InventoryHost
+		for _, h := range inv.list {
+			m1, err := path.Match(sel, h.Name)
+			if err != nil {
+				return nil, err
+			}
+			m2, _ := path.Match(sel, h.Agent.Host)
+			if m1 || m2 {
+				hosts = append(hosts, h)
+			}
+		}
+		return hosts, nil
+	}
+
+	if h := inv.lookup(sel); h != nil {
+		return []*InventoryHost{h}, nil
+	}
+
+	// Ad-hoc host that is not defined in the inventory
+	a, err := parseRemoteAgent(sel)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*InventoryHost{{Name: a.Host, Agent: *a}}, nil
+}
+
+// Resolves a list of selectors. Selectors prefixed with "!" exclude hosts.
+// If there are only excluding selectors, they are applied to all hosts.
+func (inv *Inventory) selectAll(selectors []string, seen StringSet) ([]*InventoryHost, error) {
+	var included, excluded []*InventoryHost
+
+	positive := false
+
+	for _, sel := range selectors {
+		sel = strings.TrimSpace(sel)
+		if sel == "" {
+			continue
+		}
+
+		negative := strings.HasPrefix(sel, "!")
+		if negative {
+			sel = strings.TrimSpace(sel[1:])
+		} else {
+			positive = true
+		}
+
+		hosts, err := inv.match(sel, seen)
+		if err != nil {
+			return nil, err
+		}
+
+		if negative {
+			excluded = append(excluded, hosts...)
+		} else {
+			included = append(included, hosts...)
+		}
+	}
+
+	if !positive {
+		included = inv.list
+	}
+
+	skip := make(StringSet)
+	for _, h := range excluded {
+		skip.Add(h.Agent.String())
+	}
+
+	var hosts []*InventoryHost
+	for _, h := range included {
+		if !skip.Has(h.Agent.String()) {
+			skip.Add(h.Agent.String())
+			hosts = append(hosts, h)
+		}
+	}
+
+	return hosts, nil
+}
+
+// Checks whether the selectors are resolved using the list of all hosts:
+// there are no including selectors or some of them (also in the groups)
+// are "all", globs, label selectors or negations.
+func (inv *Inventory) needsAllHosts(selectors []string, seen StringSet) bool {
+	positive := false
+
+	for _, sel := range selectors {
+		sel = strings.TrimSpace(sel)
+		switch {
+		case sel == "":
+			continue
+		case sel == "all" || sel == "@all" || strings.HasPrefix(sel, "!"):
+			return true
+		case strings.HasPrefix(sel, "@"):
+			name := sel[1:]
+			if seen.Has(name) {
+				// Infinite recursion is reported by Select
+				continue
+			}
+			seen.Add(name)
+			if inv.needsAllHosts(inv.Groups[name], seen) {
+				return true
+			}
+		case strings.ContainsAny(sel, "=*?["):
+			return true
+		}
+		positive = true
+	}
+
+	return !positive
+}
+
+// Returns the agents matching given selectors
+// or all known agents if there are no selectors.
+func (inv *Inventory) Select(selectors []string) ([]RemoteAgent, error) {
+	hosts, err := inv.selectAll(selectors, make(StringSet))
+	if err != nil {
+		return nil, err
+	}
+
+	agents := make([]RemoteAgent, 0, len(hosts))
+	for _, h := range hosts {
+		agents = append(agents, h.Agent)
+	}
+
+	return agents, nil
+}
+
+// Returns the sorted names of the inventory groups that include a host
+// with one of given names (e.g. the hostname and FQDN).
+func (inv *Inventory) GroupsOf(names ...string) ([]string, error) {
+	var groups []string
+
+	known := make(StringSet)
+	for _, n := range names {
+		if n != "" {
+			known.Add(n)
+		}
+	}
+
+	for name := range inv.Groups {
+		hosts, err := inv.match("@"+name, make(StringSet))
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hosts {
+			if known.Has(h.Name) || known.Has(h.Agent.Host) {
+				groups = append(groups, name)
+				break
+			}
+		}
+	}
+
+	sort.Strings(groups)
+
+	return groups, nil
+}
+
+// Returns the labels of a host with one of given names from the inventory file.
+// Returns nil if there is no inventory file or the host is not defined there.
+func hostLabels(names ...string) (map[string]string, error) {
+	if inventoryFile() == "" {
+		return nil, nil
+	}
+
+	inv, err := loadStaticInventory()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if h := inv.lookup(name); h != nil {
+			return h.Labels, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Type Layer is a directory of repository files that is mapped to the root
+// of the file system. Files of later layers override the same files of earlier ones.
+type Layer struct {
+	Name string // base, roles/ROLE or hosts/HOSTNAME
+	Dir  string
+}
+
+// Type LayerPath is a repository path supplied by a layer.
+type LayerPath struct {
+	Layer  Layer
+	Path   string
+	FSPath string
+}
+
+// Returns the roles of a given host from ROLES_FILE. The file maps
+// hostnames or glob patterns to the lists of roles:
+//
+//	web1.example.com: [nginx, php]
+//	"db*": [postgres]
+//
+// The roles are returned in order of appearance without duplicates.
+func hostRoles(hostname string) ([]string, error) {
+	var rules yaml.MapSlice
+
+	switch c, err := ioutil.ReadFile(ROLES_FILE); {
+	case err == nil:
+		if err := yaml.Unmarshal(c, &rules); err != nil {
+			return nil, fmt.Errorf("%s: %s", ROLES_FILE, err)
+		}
+	case os.IsNotExist(err):
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	var roles []string
+
+	seen := make(StringSet)
+
+	for _, rule := range rules {
+		pattern := fmt.Sprint(rule.Key)
+		matched, err := path.Match(pattern, hostname)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", ROLES_FILE, err)
+		}
+		if !matched {
+			continue
+		}
+
+		var list []string
+		switch v := rule.Value.(type) {
+		case string:
+			list = []string{v}
+		case []interface{}:
+			for _, x := range v {
+				list = append(list, fmt.Sprint(x))
+			}
+		default:
+			return nil, fmt.Errorf("%s: %s: roles must be a string or a list", ROLES_FILE, pattern)
+		}
+
+		for _, role := range list {
+			if !seen.Has(role) {
+				seen.Add(role)
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	return roles, nil
+}
+
+// Returns the layers of a given host in order of precedence: BASEDIR,
+// ROLESDIR/<role> for each role of the host and HOSTSDIR/<hostname>.
+// Missing directories are skipped.
+func hostLayers(hostname string) ([]Layer, error) {
+	layers := []Layer{{Name: "base", Dir: BASEDIR}}
+
+	roles, err := hostRoles(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]Layer, 0, len(roles)+1)
+	for _, role := range roles {
+		candidates = append(candidates, Layer{Name: "roles/" + role, Dir: path.Join(ROLESDIR, role)})
+	}
+	candidates = append(candidates, Layer{Name: "hosts/" + hostname, Dir: path.Join(HOSTSDIR, hostname)})
+
+	for _, l := range candidates {
+		switch fi, err := os.Stat(l.Dir); {
+		case err == nil && fi.IsDir():
+			layers = append(layers, l)
+		case err != nil && !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+
+	return layers, nil
+}
+
+// Returns the file system path of a repository file
+// and whether the repository file is a template.
+// The .absent suffix or the .template suffix and then the edit suffix
+// (see editKind) are removed.
+func layerFSPath(l Layer, repopath string) (string, bool) {
+	fspath := filepath.Join("/", strings.TrimPrefix(repopath, l.Dir))
+
+	if path.Ext(fspath) == "."+StateAbsent {
+		return strings.TrimSuffix(fspath, "."+StateAbsent), false
+	}
+
+	isTemplate := path.Ext(fspath) == ".template"
+	if isTemplate {
+		fspath = strings.TrimSuffix(fspath, ".template")
+	}
+	_, fspath = editKind(fspath)
+
+	return fspath, isTemplate
+}
+
+// Walks all layers and returns the repository paths sorted by their
+// file system paths. If several layers supply the same file system path,
+// the last one wins. But a directory of a later layer overrides the same
+// directory of an earlier one only if it has its own parameters (.#_params).
+// A non-directory of a later layer drops the content of the same directory
+// of earlier layers.
+func walkLayers(layers []Layer) []LayerPath {
+	byFSPath := make(map[string]LayerPath)
+
+	for _, l := range layers {
+		for p := range walk(l.Dir) {
+			fspath, _ := layerFSPath(l, p)
+			isDir := false
+			if fi, err := os.Lstat(p); err == nil && fi.IsDir() {
+				isDir = true
+			}
+			if prev, ok := byFSPath[fspath]; ok {
+				switch fi, err := os.Lstat(prev.Path); {
+				case err != nil || !fi.IsDir():
+				case isDir:
+					if _, err := os.Stat(path.Join(p, ".#_params")); err != nil {
+						continue
+					}
+				default:
+					for x := range byFSPath {
+						if strings.HasPrefix(x, fspath+"/") {
+							delete(byFSPath, x)
+						}
+					}
+				}
+			}
+			byFSPath[fspath] = LayerPath{Layer: l, Path: p, FSPath: fspath}
+		}
+	}
+
+	paths := make([]LayerPath, 0, len(byFSPath))
+	for _, lp := range byFSPath {
+		paths = append(paths, lp)
+	}
+
+	// Parent directories go before their content
+	sort.Slice(paths, func(i, j int) bool { return paths[i].FSPath < paths[j].FSPath })
+
+	return paths
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Creates the files of a layer, the names ending with "/" are directories.
+func makeLayer(t *testing.T, name string, files ...string) Layer {
+	dir := filepath.Join(t.TempDir(), name)
+
+	for _, f := range append([]string{"/"}, files...) {
+		p := filepath.Join(dir, f)
+		if f[len(f)-1] == '/' {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return Layer{Name: name, Dir: dir}
+}
+
+func TestWalkLayers(t *testing.T) {
+	base := makeLayer(t, "base", "etc/", "etc/app/", "etc/app/a.conf", "etc/app/b.conf", "etc/hosts", "etc/other/", "etc/other/x")
+	role := makeLayer(t, "role", "etc/", "etc/app", "etc/hosts/", "etc/hosts/y", "etc/other/", "etc/other/z")
+
+	var got []string
+	for _, lp := range walkLayers([]Layer{base, role}) {
+		got = append(got, lp.Layer.Name+":"+lp.FSPath)
+	}
+
+	want := []string{
+		"base:/etc",
+		// The file replaces the directory with its content
+		"role:/etc/app",
+		// The directory replaces the file
+		"role:/etc/hosts",
+		"role:/etc/hosts/y",
+		// Directories without parameters are merged
+		"base:/etc/other",
+		"base:/etc/other/x",
+		"role:/etc/other/z",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
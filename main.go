@@ -6,11 +6,15 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"time"
 )
 
 var (
 	// File list that will be created on current run
 	HANDLED_FILES = make(StringSet)
+	// Files that are partially managed (see editKind) on current run.
+	// They are never removed, so they are not saved to PREVIOUS_LIST
+	EDITED_FILES = make(StringSet)
 	// Keeper ignores top level directories of file system
 	IGNORED_DIRS = make(StringSet)
 
@@ -18,11 +22,42 @@ var (
 	KEEPER_SYSDIR string
 	// File list that has been created on previous run
 	PREVIOUS_LIST string
+	// Overwritten and removed files are saved here
+	BACKUPS_DIR string
+	// Per-host custom variables of templates
+	VARSDIR string
+	// Overlay layers over BASEDIR (see hostLayers)
+	ROLESDIR   string
+	HOSTSDIR   string
+	ROLES_FILE string
+	// Shared definitions that are available in all templates
+	PARTIALS_DIRS []string
+	// Encrypted secrets and the list of their recipients
+	SECRETS_DIR string
 
 	DRYRUN        bool
 	VERBOSE       bool
+	SHOW_DIFF     bool
+	OUTPUT_FORMAT = "text"
+	JSON_OUTPUT   bool
 	CONCURRENCY   int = 1
 	FORWARD_AGENT bool
+	HOST_TIMEOUT  time.Duration
+	FAIL_FAST     bool
+	STREAM        bool
+	COLOR         bool
+	OUT_DIR       string
+	PUSH_MODE     bool
+	PUSH_REV      string
+	CANARY        int
+	BATCH         string
+	PAUSE         time.Duration
+	HEALTH_CHECK  string
+	MAX_FAIL      string
+	BACKUP_RUN    string
+	LIST_BACKUPS  bool
+	SHOW_VARS     bool
+	SHOW_SECRETS  bool
 
 	VERSION = "2.0"
 )
@@ -32,31 +67,108 @@ func usage() {
 	s += "Commands:\n"
 	s += "  init\n"
 	s += "      initialize an existing repo\n\n"
-	s += "  sync | check-files [--dryrun]\n"
+	s += "  sync | check-files [--dryrun] [-diff [-show-secrets]] [-format FORMAT]\n"
 	s += "      sync repository files to the file system\n\n"
-	s += "  remote-sync [-n] [-A] [--dryrun] REPODIR [HOSTS]\n"
-	s += "      run 'git pull' on all remote agents or given hosts\n\n"
-	s += "  remote-run [-n] [-A] COMMAND [HOSTS]\n"
+	s += "  diff [-show-secrets] [PATHS]\n"
+	s += "      show differences between repository files and the file system\n\n"
+	s += "  remote-sync [-n] [-A] [-timeout] [-fail-fast] [-stream [-color]] [-out DIR] [--dryrun] [-diff] [-format FORMAT]\n"
+	s += "              [-push [-rev REV]] [-canary INT] [-batch SIZE] [-pause DURATION] [-health-check COMMAND] [-max-fail RATIO]\n"
+	s += "              REPODIR [HOSTS]\n"
+	s += "      run 'git pull' (or push the local repository) and 'keeper sync' on all remote agents or given hosts;\n"
+	s += "      with rollout options the hosts are synced batch by batch: canary hosts first, then batches of a given size\n\n"
+	s += "  remote-run [-n] [-A] [-timeout] [-fail-fast] [-stream [-color]] [-out DIR] [-format FORMAT] COMMAND [HOSTS]\n"
 	s += "      run 'command' on all remote agents or given hosts\n\n"
-	s += "  test-template FILENAME\n"
-	s += "      test an existing template file\n\n"
+	s += "  remote-apply [-n] [-A] [-timeout] [-fail-fast] [-stream [-color]] [-out DIR] [--dryrun] [-format FORMAT] [HOSTS]\n"
+	s += "      render repository files with the facts of each remote host and upload the changed ones over ssh;\n"
+	s += "      neither keeper nor the repository is required on remote hosts; overwritten and removed files\n"
+	s += "      are saved on the remote hosts into /var/backups/keeper/<RUN>/files/ (not used by 'restore')\n\n"
+	s += "  restore [-run ID] [-list] [--dryrun] [PATHS]\n"
+	s += "      restore overwritten or removed files from the latest or given backup run\n\n"
+	s += "  test-template [-show-secrets] FILENAME | -vars\n"
+	s += "      test an existing template file or print all variables available in templates\n\n"
+	s += "  secret keygen | encrypt NAME [FILE] | edit NAME\n"
+	s += "      generate the private key of this host, encrypt a YAML document from FILE (or stdin)\n"
+	s += "      or edit an encrypted one in $EDITOR; secrets are available in templates\n"
+	s += "      as .Secrets.NAME.KEY or {{ secret \"NAME.KEY\" }}\n\n"
 	s += "  version\n"
 	s += "      print version\n\n"
 	s += "Options:\n"
 	s += "  -dryrun\n"
 	s += "      perform a simulation of events that would occur but actually do nothing\n"
+	s += "  -run ID\n"
+	s += "      backup run to restore files from (default is the latest one)\n"
+	s += "  -list\n"
+	s += "      print existing backup runs and their content\n"
+	s += "  -vars\n"
+	s += "      print hostname, network interfaces, facts and custom variables (.X) in JSON\n"
+	s += "  -show-secrets\n"
+	s += "      print the content of templates that use secrets instead of hiding it\n"
+	s += "  -diff\n"
+	s += "      show unified diff of content and attributes for each changed file\n"
+	s += "  -format FORMAT\n"
+	s += "      output format: text or json (one JSON event per line) (default text)\n"
 	s += "  -n INT\n"
 	s += "      concurrent ssh sessions (default 1)\n"
+	s += "  -timeout DURATION\n"
+	s += "      kill the remote command if it runs longer than DURATION, e.g. 30s or 5m (default no limit)\n"
+	s += "  -fail-fast\n"
+	s += "      stop running the command on new hosts after the first failure\n"
+	s += "  -push\n"
+	s += "      replace the content of REPODIR on remote agents with the local repository;\n"
+	s += "      remote agents don't need git and access to the git server; only an empty REPODIR\n"
+	s += "      or one created by an earlier push is replaced\n"
+	s += "  -rev REV\n"
+	s += "      git revision to push (default is the working tree with uncommitted changes)\n"
+	s += "  -canary INT\n"
+	s += "      number of hosts in the first batch, any failure there stops the rollout\n"
+	s += "  -batch SIZE\n"
+	s += "      number of hosts (e.g. 10) or percent of all hosts (e.g. 25%) in each batch after the canary one\n"
+	s += "  -pause DURATION\n"
+	s += "      pause between batches, e.g. 30s or 5m\n"
+	s += "  -health-check COMMAND\n"
+	s += "      command that is run on the hosts of each completed batch, a failed check counts as a failure\n"
+	s += "  -max-fail RATIO\n"
+	s += "      stop the rollout when the ratio of failed hosts exceeds this value, e.g. 0.1 or 10% (default 0)\n"
+	s += "  -stream\n"
+	s += "      print the output of remote commands line by line as it arrives, prefixed with [host];\n"
+	s += "      stderr lines are printed to stderr\n"
+	s += "  -color\n"
+	s += "      color host prefixes and stderr lines in streaming mode\n"
+	s += "  -out DIR\n"
+	s += "      save stdout, stderr and status of each host into DIR/[user@]host[:port]/;\n"
+	s += "      the user and the port are omitted if they are the default ones\n"
 	s += "  -A\n"
 	s += "      enable forwarding of the authentication agent connection\n"
 	s += "  -verbose\n"
 	s += "      enable verbose output\n\n"
+	s += "Hosts:\n"
+	s += "  [user@]host[:port] | GLOB\n"
+	s += "      a host from the inventory or any other host\n"
+	s += "  @GROUP\n"
+	s += "      hosts of a group defined in the inventory\n"
+	s += "  KEY=VALUE[,KEY!=VALUE...]\n"
+	s += "      hosts whose inventory labels match all conditions (values may be globs)\n"
+	s += "  !SELECTOR\n"
+	s += "      exclude matching hosts\n\n"
+	s += "  Without selectors all hosts from inventory.yaml (or .keeper/inventory.yaml)\n"
+	s += "  and from the output of ./agents are used.\n\n"
 
-	fmt.Fprintf(os.Stderr, s)
+	fmt.Fprint(os.Stderr, s)
 
 	os.Exit(2)
 }
 
+// Checks the value of -format option.
+func parseOutputFormat() {
+	switch OUTPUT_FORMAT {
+	case "text":
+	case "json":
+		JSON_OUTPUT = true
+	default:
+		fatal("unknown output format:", OUTPUT_FORMAT)
+	}
+}
+
 func init() {
 	b, err := os.Getwd()
 	if err != nil {
@@ -65,6 +177,13 @@ func init() {
 	BASEDIR = path.Join(b, "base")
 	KEEPER_SYSDIR = path.Join(b, ".keeper")
 	PREVIOUS_LIST = path.Join(KEEPER_SYSDIR, ".previous_list")
+	BACKUPS_DIR = path.Join(KEEPER_SYSDIR, "backups")
+	VARSDIR = path.Join(b, "vars")
+	ROLESDIR = path.Join(b, "roles")
+	HOSTSDIR = path.Join(b, "hosts")
+	ROLES_FILE = path.Join(b, "roles.yaml")
+	SECRETS_DIR = path.Join(b, "secrets")
+	PARTIALS_DIRS = []string{path.Join(b, "templates"), path.Join(BASEDIR, ".#partials")}
 
 	IGNORED_DIRS.Add(
 		"/base",
@@ -99,20 +218,70 @@ func main() {
 	cmdSync := flag.NewFlagSet("", flag.ExitOnError)
 	cmdSync.Usage = usage
 	cmdSync.BoolVar(&DRYRUN, "dryrun", DRYRUN, "")
+	cmdSync.BoolVar(&SHOW_DIFF, "diff", SHOW_DIFF, "")
+	cmdSync.StringVar(&OUTPUT_FORMAT, "format", OUTPUT_FORMAT, "")
+	cmdSync.BoolVar(&SHOW_SECRETS, "show-secrets", SHOW_SECRETS, "")
+
+	cmdDiff := flag.NewFlagSet("", flag.ExitOnError)
+	cmdDiff.Usage = usage
+	cmdDiff.BoolVar(&SHOW_SECRETS, "show-secrets", SHOW_SECRETS, "")
 
 	cmdRSync := flag.NewFlagSet("", flag.ExitOnError)
 	cmdRSync.Usage = usage
 	cmdRSync.BoolVar(&DRYRUN, "dryrun", DRYRUN, "")
+	cmdRSync.BoolVar(&SHOW_DIFF, "diff", SHOW_DIFF, "")
+	cmdRSync.StringVar(&OUTPUT_FORMAT, "format", OUTPUT_FORMAT, "")
+	cmdRSync.BoolVar(&PUSH_MODE, "push", PUSH_MODE, "")
+	cmdRSync.StringVar(&PUSH_REV, "rev", PUSH_REV, "")
+	cmdRSync.IntVar(&CANARY, "canary", CANARY, "")
+	cmdRSync.StringVar(&BATCH, "batch", BATCH, "")
+	cmdRSync.DurationVar(&PAUSE, "pause", PAUSE, "")
+	cmdRSync.StringVar(&HEALTH_CHECK, "health-check", HEALTH_CHECK, "")
+	cmdRSync.StringVar(&MAX_FAIL, "max-fail", MAX_FAIL, "")
 	cmdRSync.IntVar(&CONCURRENCY, "n", CONCURRENCY, "")
 	cmdRSync.BoolVar(&FORWARD_AGENT, "A", FORWARD_AGENT, "")
+	cmdRSync.DurationVar(&HOST_TIMEOUT, "timeout", HOST_TIMEOUT, "")
+	cmdRSync.BoolVar(&FAIL_FAST, "fail-fast", FAIL_FAST, "")
+	cmdRSync.BoolVar(&STREAM, "stream", STREAM, "")
+	cmdRSync.BoolVar(&COLOR, "color", COLOR, "")
+	cmdRSync.StringVar(&OUT_DIR, "out", OUT_DIR, "")
 
 	cmdRRun := flag.NewFlagSet("", flag.ExitOnError)
 	cmdRRun.Usage = usage
 	cmdRRun.IntVar(&CONCURRENCY, "n", CONCURRENCY, "")
 	cmdRRun.BoolVar(&FORWARD_AGENT, "A", FORWARD_AGENT, "")
+	cmdRRun.DurationVar(&HOST_TIMEOUT, "timeout", HOST_TIMEOUT, "")
+	cmdRRun.BoolVar(&FAIL_FAST, "fail-fast", FAIL_FAST, "")
+	cmdRRun.BoolVar(&STREAM, "stream", STREAM, "")
+	cmdRRun.BoolVar(&COLOR, "color", COLOR, "")
+	cmdRRun.StringVar(&OUT_DIR, "out", OUT_DIR, "")
+	cmdRRun.StringVar(&OUTPUT_FORMAT, "format", OUTPUT_FORMAT, "")
+
+	cmdRApply := flag.NewFlagSet("", flag.ExitOnError)
+	cmdRApply.Usage = usage
+	cmdRApply.BoolVar(&DRYRUN, "dryrun", DRYRUN, "")
+	cmdRApply.IntVar(&CONCURRENCY, "n", CONCURRENCY, "")
+	cmdRApply.BoolVar(&FORWARD_AGENT, "A", FORWARD_AGENT, "")
+	cmdRApply.DurationVar(&HOST_TIMEOUT, "timeout", HOST_TIMEOUT, "")
+	cmdRApply.BoolVar(&FAIL_FAST, "fail-fast", FAIL_FAST, "")
+	cmdRApply.BoolVar(&STREAM, "stream", STREAM, "")
+	cmdRApply.BoolVar(&COLOR, "color", COLOR, "")
+	cmdRApply.StringVar(&OUT_DIR, "out", OUT_DIR, "")
+	cmdRApply.StringVar(&OUTPUT_FORMAT, "format", OUTPUT_FORMAT, "")
+
+	cmdRestore := flag.NewFlagSet("", flag.ExitOnError)
+	cmdRestore.Usage = usage
+	cmdRestore.BoolVar(&DRYRUN, "dryrun", DRYRUN, "")
+	cmdRestore.StringVar(&BACKUP_RUN, "run", BACKUP_RUN, "")
+	cmdRestore.BoolVar(&LIST_BACKUPS, "list", LIST_BACKUPS, "")
 
 	cmdTpl := flag.NewFlagSet("", flag.ExitOnError)
 	cmdTpl.Usage = usage
+	cmdTpl.BoolVar(&SHOW_VARS, "vars", SHOW_VARS, "")
+	cmdTpl.BoolVar(&SHOW_SECRETS, "show-secrets", SHOW_SECRETS, "")
+
+	cmdSecret := flag.NewFlagSet("", flag.ExitOnError)
+	cmdSecret.Usage = usage
 
 	cmdVer := flag.NewFlagSet("", flag.ExitOnError)
 	cmdVer.Usage = usage
@@ -141,6 +310,7 @@ func main() {
 			fatal("init variables error:", err)
 		}
 		cmdSync.Parse(flag.Args()[1:])
+		parseOutputFormat()
 		switch _, err := os.Stat(KEEPER_SYSDIR); {
 		case os.IsNotExist(err):
 			fmt.Println("Run  'keeper init'  first to initialize Keeper")
@@ -151,8 +321,17 @@ func main() {
 		if err := syncRepo(); err != nil {
 			fatal("syncing error:", err)
 		}
+	case "diff":
+		if err := initVariables(); err != nil {
+			fatal("init variables error:", err)
+		}
+		cmdDiff.Parse(flag.Args()[1:])
+		if err := diffRepo(cmdDiff.Args()); err != nil {
+			fatal("diff error:", err)
+		}
 	case "remote-sync", "rs":
 		cmdRSync.Parse(flag.Args()[1:])
+		parseOutputFormat()
 		var hosts []string
 		switch {
 		case cmdRSync.NArg() < 1:
@@ -161,18 +340,17 @@ func main() {
 			hosts = cmdRSync.Args()[1:]
 		}
 
-		cmd := "keeper sync"
-		if DRYRUN {
-			cmd = "DRYRUN=1 " + cmd
+		rollout, err := parseRolloutStrategy(CANARY, BATCH, PAUSE, HEALTH_CHECK, MAX_FAIL)
+		if err != nil {
+			fatal(err)
 		}
-		cmd = "MANUAL=1 git pull; " + cmd
-		cmd = "cd " + cmdRSync.Arg(0) + "; " + cmd
 
-		if err := remoteCommand(cmd, hosts); err != nil {
+		if err := remoteSync(cmdRSync.Arg(0), hosts, rollout); err != nil {
 			fatal("remote syncing error:", err)
 		}
 	case "remote-run", "rr":
 		cmdRRun.Parse(flag.Args()[1:])
+		parseOutputFormat()
 		var hosts []string
 		switch {
 		case cmdRRun.NArg() < 1:
@@ -180,19 +358,58 @@ func main() {
 		case cmdRRun.NArg() > 1:
 			hosts = cmdRRun.Args()[1:]
 		}
-		if err := remoteCommand(cmdRRun.Arg(0), hosts); err != nil {
+		if err := remoteCommand(cmdRRun.Arg(0), hosts, nil, remoteOptions()); err != nil {
 			fatal("remote execution error:", err)
 		}
+	case "remote-apply", "ra":
+		cmdRApply.Parse(flag.Args()[1:])
+		parseOutputFormat()
+		if err := remoteApply(cmdRApply.Args()); err != nil {
+			fatal("remote applying error:", err)
+		}
+	case "restore":
+		cmdRestore.Parse(flag.Args()[1:])
+		if LIST_BACKUPS {
+			if err := listBackups(); err != nil {
+				fatal("backups listing error:", err)
+			}
+			break
+		}
+		if err := restoreBackup(BACKUP_RUN, cmdRestore.Args()); err != nil {
+			fatal("restoring error:", err)
+		}
 	case "test-template", "tt":
 		if err := initVariables(); err != nil {
 			fatal("init variables error:", err)
 		}
 		cmdTpl.Parse(flag.Args()[1:])
-		if cmdTpl.NArg() != 1 {
+		switch {
+		case SHOW_VARS && cmdTpl.NArg() == 0:
+			if err := printVariables(); err != nil {
+				fatal(err)
+			}
+		case SHOW_VARS || cmdTpl.NArg() != 1:
+			flag.Usage()
+		default:
+			if err := testTemplate(cmdTpl.Arg(0)); err != nil {
+				fatal("template execution error:", err)
+			}
+		}
+	case "secret":
+		cmdSecret.Parse(flag.Args()[1:])
+		var err error
+		switch args := cmdSecret.Args(); {
+		case len(args) == 1 && args[0] == "keygen":
+			err = secretKeygen()
+		case (len(args) == 2 || len(args) == 3) && args[0] == "encrypt":
+			err = secretEncrypt(args[1], cmdSecret.Arg(2))
+		case len(args) == 2 && args[0] == "edit":
+			err = secretEdit(args[1])
+		default:
 			flag.Usage()
 		}
-		if err := testTemplate(cmdTpl.Arg(0)); err != nil {
-			fatal("template execution error:", err)
+		if err != nil {
+			fatal("secret error:", err)
 		}
 	case "version", "ver", "v":
 		fmt.Printf("v%s, (built %s)\n", VERSION, runtime.Version())
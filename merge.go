@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Deeply merges the fragment src into the current content of a YAML, JSON
+// or INI document (by the file extension ext). Nested mappings and INI sections
+// are merged, all other values (including lists) are replaced. The order
+// of existing keys is kept and new keys are appended.
+//
+// Only the values set by the fragment are changed, all other values keep
+// their original text. The current content is returned as is if the merge
+// changes nothing, so the file is reformatted only when the values change.
+func mergeDocument(ext string, current, src []byte) ([]byte, error) {
+	switch ext {
+	case ".ini":
+		return mergeINI(current, src)
+	case ".json":
+		return mergeJSON(current, src)
+	}
+	return mergeYAML(current, src)
+}
+
+// Returns the top-level mapping of a YAML document.
+// An empty document is an empty mapping.
+func yamlMapping(doc *yaml.Node) (*yaml.Node, error) {
+	if doc.Kind == 0 {
+		doc.Kind = yaml.DocumentNode
+	}
+	if len(doc.Content) == 0 {
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	if m := doc.Content[0]; m.Kind == yaml.MappingNode {
+		return m, nil
+	}
+	return nil, fmt.Errorf("not a mapping")
+}
+
+// Parses the documents into yaml.Node trees, so the scalars keep their original
+// text and comments, and merges the fragment nodes into the current ones.
+func mergeYAML(current, src []byte) ([]byte, error) {
+	var doc, frag yaml.Node
+
+	if err := yaml.Unmarshal(current, &doc); err != nil {
+		return nil, fmt.Errorf("current document: %s", err)
+	}
+	dst, err := yamlMapping(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("current document: %s", err)
+	}
+
+	if err := yaml.Unmarshal(src, &frag); err != nil {
+		return nil, err
+	}
+	m, err := yamlMapping(&frag)
+	if err != nil {
+		return nil, err
+	}
+
+	if !mergeYAMLNodes(dst, m) {
+		return current, nil
+	}
+
+	var buf bytes.Buffer
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Merges the mapping node src into dst. Returns true if dst has changed.
+func mergeYAMLNodes(dst, src *yaml.Node) bool {
+	changed := false
+
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+
+		j := 0
+		for j < len(dst.Content) && dst.Content[j].Value != key.Value {
+			j += 2
+		}
+		if j >= len(dst.Content) {
+			dst.Content = append(dst.Content, key, value)
+			changed = true
+			continue
+		}
+
+		old := dst.Content[j+1]
+		switch {
+		case old.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			if mergeYAMLNodes(old, value) {
+				changed = true
+			}
+		case !equalYAMLNodes(old, value):
+			if value.LineComment == "" {
+				value.LineComment = old.LineComment
+			}
+			dst.Content[j+1] = value
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func equalYAMLNodes(a, b *yaml.Node) bool {
+	if a.Kind != b.Kind || a.ShortTag() != b.ShortTag() || a.Value != b.Value || len(a.Content) != len(b.Content) {
+		return false
+	}
+	for i := range a.Content {
+		if !equalYAMLNodes(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Type jsonObject is a JSON object with the original order of members.
+// The values are either jsonObject or json.RawMessage (arrays and scalars),
+// so they keep their original text.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	Key   string
+	Value interface{}
+}
+
+func parseJSONObject(data []byte) (jsonObject, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	switch t, err := dec.Token(); {
+	case err == io.EOF:
+		// An empty document
+		return jsonObject{}, nil
+	case err != nil:
+		return nil, err
+	case t != json.Delim('{'):
+		return nil, fmt.Errorf("not an object")
+	}
+
+	var obj jsonObject
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := t.(string)
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+
+		var value interface{} = raw
+		if bytes.HasPrefix(raw, []byte("{")) {
+			if value, err = parseJSONObject(raw); err != nil {
+				return nil, err
+			}
+		}
+
+		obj = append(obj, jsonMember{Key: key, Value: value})
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the top-level object")
+	}
+
+	return obj, nil
+}
+
+// Merges the object src into dst. Returns the result and true if it differs from dst.
+func mergeJSONObjects(dst, src jsonObject) (jsonObject, bool) {
+	res := append(jsonObject{}, dst...)
+	changed := false
+
+	for _, m := range src {
+		i := 0
+		for i < len(res) && res[i].Key != m.Key {
+			i++
+		}
+		if i == len(res) {
+			res = append(res, m)
+			changed = true
+			continue
+		}
+
+		do, ok1 := res[i].Value.(jsonObject)
+		so, ok2 := m.Value.(jsonObject)
+		if ok1 && ok2 {
+			merged, ok := mergeJSONObjects(do, so)
+			res[i].Value = merged
+			changed = changed || ok
+			continue
+		}
+
+		if !bytes.Equal(compactJSON(res[i].Value), compactJSON(m.Value)) {
+			res[i].Value = m.Value
+			changed = true
+		}
+	}
+
+	return res, changed
+}
+
+// Encodes a JSON value without insignificant whitespace.
+func compactJSON(v interface{}) []byte {
+	var buf bytes.Buffer
+
+	switch x := v.(type) {
+	case jsonObject:
+		buf.WriteByte('{')
+		for i, m := range x {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			k, _ := json.Marshal(m.Key)
+			buf.Write(k)
+			buf.WriteByte(':')
+			buf.Write(compactJSON(m.Value))
+		}
+		buf.WriteByte('}')
+	case json.RawMessage:
+		json.Compact(&buf, x)
+	}
+
+	return buf.Bytes()
+}
+
+func mergeJSON(current, src []byte) ([]byte, error) {
+	doc, err := parseJSONObject(current)
+	if err != nil {
+		return nil, fmt.Errorf("current document: %s", err)
+	}
+	frag, err := parseJSONObject(src)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, changed := mergeJSONObjects(doc, frag)
+	if !changed {
+		return current, nil
+	}
+
+	var out bytes.Buffer
+
+	if err := json.Indent(&out, compactJSON(merged), "", detectIndent(current)); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+
+	return out.Bytes(), nil
+}
+
+// Returns the indentation of the first indented line or two spaces.
+func detectIndent(content []byte) string {
+	for _, line := range strings.Split(string(content), "\n") {
+		if t := strings.TrimLeft(line, " \t"); t != "" && len(t) < len(line) {
+			return line[:len(line)-len(t)]
+		}
+	}
+	return "  "
+}
+
+// Type iniEntry is a "key = value" line of an INI document.
+type iniEntry struct {
+	Section string
+	Key     string
+	Value   string
+	Line    string
+}
+
+// Returns the section name if the line is a section header.
+func iniSection(line string) (string, bool) {
+	if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+		return strings.TrimSpace(line[1 : len(line)-1]), true
+	}
+	return "", false
+}
+
+// Parses a trimmed "key = value" line. Comments and empty lines are skipped.
+func iniKeyValue(line string) (string, string, bool) {
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+		return "", "", false
+	}
+	fields := strings.SplitN(line, "=", 2)
+	if len(fields) != 2 {
+		return "", "", false
+	}
+	return strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]), true
+}
+
+func parseINI(content []byte) ([]iniEntry, error) {
+	var entries []iniEntry
+
+	var section string
+
+	for n, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if name, ok := iniSection(line); ok {
+			section = name
+			continue
+		}
+		key, value, ok := iniKeyValue(line)
+		switch {
+		case ok:
+			entries = append(entries, iniEntry{Section: section, Key: key, Value: value, Line: line})
+		case line != "" && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, ";"):
+			return nil, fmt.Errorf("line %d: incorrect INI entry: %s", n+1, line)
+		}
+	}
+
+	return entries, nil
+}
+
+// Sets the keys of the INI fragment src in the current content line by line,
+// so the comments and the formatting of other lines are kept. New keys are added
+// to the end of their sections, new sections are appended to the end.
+func mergeINI(current, src []byte) ([]byte, error) {
+	entries, err := parseINI(src)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(current), "\n")
+	if n := len(lines); lines[n-1] == "" {
+		lines = lines[:n-1]
+	}
+
+	changed := false
+
+	for _, e := range entries {
+		// Keys before the first header belong to the global section
+		found := e.Section == ""
+		insertAt, keyAt, same := 0, -1, false
+
+		var section string
+		for i, line := range lines {
+			line = strings.TrimSpace(line)
+			if name, ok := iniSection(line); ok {
+				section = name
+				if section == e.Section && !found {
+					found, insertAt = true, i+1
+				}
+				continue
+			}
+			if section != e.Section || line == "" {
+				continue
+			}
+			insertAt = i + 1
+			if key, value, ok := iniKeyValue(line); ok && key == e.Key && keyAt < 0 {
+				keyAt, same = i, value == e.Value
+			}
+		}
+
+		switch {
+		case same:
+			continue
+		case keyAt >= 0:
+			lines[keyAt] = e.Line
+		case found:
+			lines = append(lines[:insertAt], append([]string{e.Line}, lines[insertAt:]...)...)
+		default:
+			if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+				lines = append(lines, "")
+			}
+			lines = append(lines, "["+e.Section+"]", e.Line)
+		}
+		changed = true
+	}
+
+	if !changed {
+		return current, nil
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
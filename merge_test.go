@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMergeDocument(t *testing.T) {
+	tests := []struct {
+		name    string
+		ext     string
+		current string
+		src     string
+		want    string
+	}{
+		{
+			name:    "yaml keeps 1.1 booleans",
+			ext:     ".yaml",
+			current: "on: yes\nother: 1\n",
+			src:     "other: 2\n",
+			want:    "on: yes\nother: 2\n",
+		},
+		{
+			name:    "yaml keeps numbers, quotes and comments",
+			ext:     ".yaml",
+			current: "# config\nversion: 1.0\nname: 'x' # name\nserver:\n  port: 80\n  host: a\n",
+			src:     "server:\n  port: 8080\n",
+			want:    "# config\nversion: 1.0\nname: 'x' # name\nserver:\n  port: 8080\n  host: a\n",
+		},
+		{
+			name:    "yaml new keys are appended",
+			ext:     ".yaml",
+			current: "a: 1\n",
+			src:     "b:\n  c: 2\n",
+			want:    "a: 1\nb:\n  c: 2\n",
+		},
+		{
+			name:    "yaml empty document",
+			ext:     ".yaml",
+			current: "",
+			src:     "a: 1\n",
+			want:    "a: 1\n",
+		},
+		{
+			name:    "yaml lists are replaced",
+			ext:     ".yaml",
+			current: "l:\n  - 1\n  - 2\n",
+			src:     "l: [3]\n",
+			want:    "l: [3]\n",
+		},
+		{
+			name:    "json keeps number text",
+			ext:     ".json",
+			current: "{\n  \"b\": 1.0,\n  \"s\": \"\\u00e9\"\n}\n",
+			src:     `{"c": 2}`,
+			want:    "{\n  \"b\": 1.0,\n  \"s\": \"\\u00e9\",\n  \"c\": 2\n}\n",
+		},
+		{
+			name:    "json nested objects are merged",
+			ext:     ".json",
+			current: "{\n\t\"log\": {\n\t\t\"level\": \"info\",\n\t\t\"file\": \"/var/log/x\"\n\t}\n}\n",
+			src:     `{"log": {"level": "debug"}}`,
+			want:    "{\n\t\"log\": {\n\t\t\"level\": \"debug\",\n\t\t\"file\": \"/var/log/x\"\n\t}\n}\n",
+		},
+		{
+			name:    "json empty document",
+			ext:     ".json",
+			current: "",
+			src:     `{"a": true}`,
+			want:    "{\n  \"a\": true\n}\n",
+		},
+		{
+			name:    "ini keeps comments and formatting",
+			ext:     ".ini",
+			current: "g=1\n[main]\n; comment\na = 1\nb=2\n\n[other]\nx=1\n",
+			src:     "[main]\nb = 3\nc = 4\n[new]\ny = 5\n",
+			want:    "g=1\n[main]\n; comment\na = 1\nb = 3\nc = 4\n\n[other]\nx=1\n\n[new]\ny = 5\n",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := mergeDocument(tt.ext, []byte(tt.current), []byte(tt.src))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", tt.name, got, tt.want)
+			continue
+		}
+		// Merging again changes nothing
+		again, err := mergeDocument(tt.ext, got, []byte(tt.src))
+		if err != nil || string(again) != string(got) {
+			t.Errorf("%s: second merge changed the document:\n%s", tt.name, again)
+		}
+	}
+}
+
+func TestMergeDocumentUnchanged(t *testing.T) {
+	tests := []struct {
+		ext     string
+		current string
+		src     string
+	}{
+		{".yaml", "on: yes\nport: 80 # http\n", "port: 80\n"},
+		{".json", "{\"b\": 1.0, \"port\": 80}", `{"port": 80}`},
+		{".ini", "[main]\nport=80\n", "[main]\nport = 80\n"},
+	}
+
+	for _, tt := range tests {
+		got, err := mergeDocument(tt.ext, []byte(tt.current), []byte(tt.src))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.ext, err)
+			continue
+		}
+		if string(got) != tt.current {
+			t.Errorf("%s: document changed:\n%s", tt.ext, got)
+		}
+	}
+}
+
+func TestMergeDocumentErrors(t *testing.T) {
+	tests := []struct {
+		ext     string
+		current string
+		src     string
+	}{
+		{".yaml", "- 1\n- 2\n", "a: 1\n"},
+		{".yaml", "a: 1\n", "- 1\n"},
+		{".json", "[1, 2]", `{"a": 1}`},
+		{".json", `{"a": 1}`, `{"a": `},
+		{".ini", "", "[main]\nnot an entry\n"},
+	}
+
+	for _, tt := range tests {
+		if _, err := mergeDocument(tt.ext, []byte(tt.current), []byte(tt.src)); err == nil {
+			t.Errorf("%s: no error for %q + %q", tt.ext, tt.current, strings.TrimSpace(tt.src))
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
@@ -36,6 +37,23 @@ func permsToFileMode(perms os.FileMode) (mode os.FileMode) {
 	return mode
 }
 
+// Converts a FileMode structure to Unix permissions (the opposite of permsToFileMode).
+func fileModeToPerms(mode os.FileMode) (perms os.FileMode) {
+	perms = mode.Perm()
+
+	if mode&os.ModeSticky != 0 {
+		perms |= StickyBit
+	}
+	if mode&os.ModeSetgid != 0 {
+		perms |= SetgidBit
+	}
+	if mode&os.ModeSetuid != 0 {
+		perms |= SetuidBit
+	}
+
+	return perms
+}
+
 // Returns true if both files definitely have the same content.
 func equalContent(fname1, fname2 string) bool {
 	if fname1 == fname2 {
@@ -100,13 +118,21 @@ func equalContent(fname1, fname2 string) bool {
 }
 
 // Copies content from srcname to dstname and sets the access attributes and the owner/group.
-func copyFileContents(srcname, dstname string, mode os.FileMode, uid, gid int) error {
+// If check command is defined, it's run against the temporary file before renaming.
+func copyFileContents(srcname, dstname string, mode os.FileMode, uid, gid int, check string) error {
 	in, err := os.Open(srcname)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
 
+	return writeFileContents(in, dstname, mode, uid, gid, check)
+}
+
+// Writes content from r to dstname through a temporary file
+// and sets the access attributes and the owner/group.
+// If check command is defined, it's run against the temporary file before renaming.
+func writeFileContents(r io.Reader, dstname string, mode os.FileMode, uid, gid int, check string) error {
 	tmpfile, err := ioutil.TempFile(filepath.Dir(dstname), "keeper")
 	if err != nil {
 		return err
@@ -114,7 +140,7 @@ func copyFileContents(srcname, dstname string, mode os.FileMode, uid, gid int) e
 	defer tmpfile.Close()
 	defer os.Remove(tmpfile.Name())
 
-	if _, err = io.Copy(tmpfile, in); err != nil {
+	if _, err = io.Copy(tmpfile, r); err != nil {
 		return err
 	}
 	if err := tmpfile.Close(); err != nil {
@@ -128,9 +154,41 @@ func copyFileContents(srcname, dstname string, mode os.FileMode, uid, gid int) e
 		return err
 	}
 
+	if check != "" {
+		if err := runCheck(check, tmpfile.Name()); err != nil {
+			return fmt.Errorf("%s: %s", dstname, err)
+		}
+	}
+
 	return os.Rename(tmpfile.Name(), dstname)
 }
 
+// Runs a check command against fname. Each %s in the command is replaced
+// with the file name, otherwise the file name is appended to the end.
+func runCheck(check, fname string) error {
+	cmd := checkCommand(check, shellQuote(fname))
+
+	if out, err := exec.Command("/bin/sh", "-c", cmd).CombinedOutput(); err != nil {
+		return fmt.Errorf("check %q failed: %s: %s", check, err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+// Substitutes a quoted file name into a check command: each %s is replaced
+// with the file name, otherwise the file name is appended to the end.
+func checkCommand(check, quoted string) string {
+	if strings.Contains(check, "%s") {
+		return strings.Replace(check, "%s", quoted, -1)
+	}
+	return check + " " + quoted
+}
+
+// Quotes a string to be used as a single word in shell commands.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 // Type based on map for simple operation with string lists.
 type StringSet map[string]struct{}
 
@@ -149,6 +207,34 @@ func (ss StringSet) Remove(v string) {
 	delete(ss, v)
 }
 
+// Returns true if p is one of the given paths or is located under one of them.
+// An empty list matches any path, "/" matches any absolute path.
+func underPaths(p string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, x := range paths {
+		x = filepath.Clean(x)
+		if p == x || strings.HasPrefix(p, strings.TrimSuffix(x, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the absolute forms of given paths (see filepath.Abs).
+func absPaths(paths []string) ([]string, error) {
+	res := make([]string, 0, len(paths))
+	for _, x := range paths {
+		a, err := filepath.Abs(x)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+	return res, nil
+}
+
 // Walks the BASEDIR and returns all visited files/directories via channel.
 func walk(rootdir string) chan string {
 	cPaths := make(chan string, 1)
@@ -157,7 +243,14 @@ func walk(rootdir string) chan string {
 		if err != nil {
 			return err
 		}
-		if p == rootdir || strings.HasPrefix(path.Base(p), ".#") {
+		switch {
+		case p == rootdir:
+			return nil
+		case strings.HasPrefix(path.Base(p), ".#"):
+			// Service directories like .#partials are skipped entirely
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 		cPaths <- p
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestUnderPaths(t *testing.T) {
+	tests := []struct {
+		p     string
+		paths []string
+		want  bool
+	}{
+		{"/etc/hosts", nil, true},
+		{"/etc/hosts", []string{"/"}, true},
+		{"/", []string{"/"}, true},
+		{"/etc/hosts", []string{"/etc"}, true},
+		{"/etc/hosts", []string{"/etc/"}, true},
+		{"/etc/hosts", []string{"/etc/hosts"}, true},
+		{"/etc", []string{"/etc/hosts"}, false},
+		{"/etc2/hosts", []string{"/etc"}, false},
+		{"/etc/hosts", []string{"/var", "/etc"}, true},
+		{"/etc/hosts", []string{"/var", "/usr"}, false},
+		{"/etc/nginx/sites", []string{"/etc/../etc/nginx"}, true},
+	}
+
+	for _, tt := range tests {
+		if got := underPaths(tt.p, tt.paths); got != tt.want {
+			t.Errorf("underPaths(%q, %q) = %v, want %v", tt.p, tt.paths, got, tt.want)
+		}
+	}
+}
+
+func TestAbsPaths(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := absPaths([]string{"/", "/etc/", "etc/hosts", "."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/", "/etc", filepath.Join(wd, "etc/hosts"), wd}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var emitLock sync.Mutex
+
+// Type SyncEvent describes a single action performed by sync.
+type SyncEvent struct {
+	Action   string `json:"action"` // create, update, remove, skip or hook
+	Path     string `json:"path,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Template bool   `json:"template,omitempty"`
+	Edit     string `json:"edit,omitempty"`
+	Layer    string `json:"layer,omitempty"`
+	OldMode  string `json:"old_mode,omitempty"`
+	NewMode  string `json:"new_mode,omitempty"`
+	OldUid   *int   `json:"old_uid,omitempty"`
+	OldGid   *int   `json:"old_gid,omitempty"`
+	Uid      *int   `json:"uid,omitempty"`
+	Gid      *int   `json:"gid,omitempty"`
+	Command  string `json:"command,omitempty"`
+	Diff     string `json:"diff,omitempty"`
+	Dryrun   bool   `json:"dryrun,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Type RemoteEvent describes the result of a command executed on a remote agent.
+type RemoteEvent struct {
+	Host     string  `json:"host" yaml:"host"`
+	User     string  `json:"user" yaml:"user"`
+	Port     int     `json:"port" yaml:"port"`
+	Command  string  `json:"command" yaml:"command"`
+	Started  string  `json:"started" yaml:"started"`
+	Status   string  `json:"status" yaml:"status"` // see Status* constants
+	ExitCode int     `json:"exit_code" yaml:"exit_code"`
+	Duration float64 `json:"duration" yaml:"duration"` // in seconds
+	Output   string  `json:"output" yaml:"-"`
+	Stderr   string  `json:"stderr" yaml:"-"`
+	Error    string  `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Returns a new event filled with the current state of fspath (if it exists).
+func newFSEvent(action, fspath string) *SyncEvent {
+	ev := SyncEvent{
+		Action: action,
+		Path:   fspath,
+		Dryrun: DRYRUN,
+	}
+
+	if fi, err := os.Lstat(fspath); err == nil {
+		ev.OldMode = fi.Mode().String()
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			uid, gid := int(st.Uid), int(st.Gid)
+			ev.OldUid, ev.OldGid = &uid, &gid
+		}
+	}
+
+	return &ev
+}
+
+// Returns a new event for the repository file. The action is "update"
+// if the file exists in the file system and "create" otherwise.
+func newRepoFileEvent(rf *RepositoryFile) *SyncEvent {
+	ev := newFSEvent("create", rf.FSPath)
+	if ev.OldMode != "" {
+		ev.Action = "update"
+	}
+
+	uid, gid := rf.Uid, rf.Gid
+
+	ev.Source = rf.Path
+	ev.Template = rf.IsTemplate
+	ev.Edit = rf.Edit
+	ev.Layer = rf.Layer
+	ev.NewMode = rf.Mode.String()
+	ev.Uid, ev.Gid = &uid, &gid
+
+	return ev
+}
+
+// Writes a given event to the standard output as a single JSON line.
+func emitEvent(ev interface{}) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		warn(err)
+		return
+	}
+
+	emitLock.Lock()
+	defer emitLock.Unlock()
+
+	os.Stdout.Write(append(b, '\n'))
+}
+
+// Prints the arguments in the text output mode only.
+func textln(a ...interface{}) {
+	if !JSON_OUTPUT {
+		fmt.Println(a...)
+	}
+}
+
+// Formats and prints the arguments in the text output mode only.
+func textf(format string, a ...interface{}) {
+	if !JSON_OUTPUT {
+		fmt.Printf(format, a...)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Packs a given revision of the local repository into a temporary tar file
+// and returns its name. If rev is empty, the working tree is packed
+// including uncommitted changes of tracked files. The content of submodules
+// is included too.
+func packRepository(rev string) (string, error) {
+	if rev == "" {
+		// "git stash create" makes a commit of the working tree
+		// without touching it. The output is empty if there are no changes.
+		out, err := exec.Command("git", "stash", "create").Output()
+		if err != nil {
+			return "", fmt.Errorf("git stash create: %s", err)
+		}
+		rev = strings.TrimSpace(string(out))
+		if rev == "" {
+			rev = "HEAD"
+		}
+	}
+
+	tmpfile, err := ioutil.TempFile("", ".keeper_push_")
+	if err != nil {
+		return "", err
+	}
+
+	tw := tar.NewWriter(tmpfile)
+
+	err = archiveTree(tw, ".", rev, "")
+	if err == nil {
+		err = tw.Close()
+	}
+	if err1 := tmpfile.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return "", err
+	}
+
+	return tmpfile.Name(), nil
+}
+
+// Writes the tree of a given revision of the git repository in dir to tw
+// with a given path prefix. "git archive" leaves out the content of submodules,
+// so they are archived from their own repositories the same way.
+func archiveTree(tw *tar.Writer, dir, rev, prefix string) error {
+	cmd := exec.Command("git", "archive", "--format=tar", "--prefix="+prefix, rev)
+	cmd.Dir = dir
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err = copyTar(tw, tar.NewReader(stdout))
+	if err != nil {
+		// Let git exit if the output isn't read to the end
+		io.Copy(ioutil.Discard, stdout)
+	}
+	if err1 := cmd.Wait(); err1 != nil {
+		return fmt.Errorf("git archive %s (%s): %s: %s", rev, dir, err1, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Submodules are the tree entries of the "commit" type
+	cmd = exec.Command("git", "ls-tree", "-r", "-z", rev)
+	cmd.Dir = dir
+
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("git ls-tree %s (%s): %s", rev, dir, err)
+	}
+
+	for _, entry := range strings.Split(string(out), "\x00") {
+		// <mode> SP <type> SP <object> TAB <path>
+		fields := strings.SplitN(entry, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		info := strings.Fields(fields[0])
+		if len(info) != 3 || info[1] != "commit" {
+			continue
+		}
+
+		subdir := path.Join(dir, fields[1])
+		if _, err := os.Stat(path.Join(subdir, ".git")); err != nil {
+			return fmt.Errorf("submodule %s is not checked out, run \"git submodule update --init --recursive\"", path.Join(prefix, fields[1]))
+		}
+		if err := archiveTree(tw, subdir, info[2], prefix+fields[1]+"/"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copies the entries of a tar archive to tw.
+func copyTar(tw *tar.Writer, tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+		// The pax header with the commit ID is not a file
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// File in the Keeper's system directory on remote agents that marks
+// a repository directory created by push, so it can be replaced.
+const pushMarker = ".keeper/pushed"
+
+// Returns a shell script that replaces the content of repodir
+// with a tar archive read from stdin. The Keeper's system directory is kept.
+// Only an empty directory or one created by an earlier push is replaced.
+// In dry-run mode the archive is unpacked into a temporary directory
+// together with a copy of the Keeper's system directory, repodir is not changed.
+func unpackScript(repodir string, dryrun bool) (string, error) {
+	repodir = path.Clean(repodir)
+	if repodir == "/" || repodir == "." || repodir == "" {
+		return "", fmt.Errorf("unsafe repository directory: %q", repodir)
+	}
+
+	dir := shellQuote(repodir)
+
+	s := "set -e; "
+	s += "if [ -d " + dir + " ]; then "
+	s += "cd " + dir + "; "
+	s += "[ ! -e .git ] || { echo " + shellQuote(repodir+" is a git repository, use pull mode") + " >&2; exit 1; }; "
+	s += `[ -z "$(ls -A)" ] || [ -e ` + pushMarker + " ] || { echo " + shellQuote(repodir+" is not empty and was not created by push") + " >&2; exit 1; }; "
+	s += "fi; "
+
+	if dryrun {
+		s += `t=$(mktemp -d); trap 'rm -rf "$t"' EXIT; `
+		s += "[ ! -d " + dir + "/.keeper ] || cp -a " + dir + `/.keeper "$t/"; `
+		s += `cd "$t"; tar -xf -; `
+		s += "mkdir -p .keeper; "
+		return s, nil
+	}
+
+	s += "mkdir -p " + dir + "; cd " + dir + "; "
+	s += "find . -mindepth 1 -maxdepth 1 ! -name .keeper -exec rm -rf {} +; "
+	s += "tar -xf -; "
+	s += "mkdir -p .keeper; touch " + pushMarker + "; "
+
+	return s, nil
+}
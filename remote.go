@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
 
 	"github.com/0xef53/go-sshwrapper"
 )
@@ -21,129 +27,464 @@ type RemoteAgent struct {
 	Port int
 }
 
-func ParseRemoteAgents(entries []string) ([]RemoteAgent, error) {
-	if entries == nil {
-		switch out, err := exec.Command("./agents").Output(); {
-		case err == nil:
-			entries = strings.Fields(string(out))
-		case !os.IsNotExist(err):
-			return nil, fmt.Errorf("%s: %s", err, out)
-		}
+// Returns the agents matching given host selectors (see Inventory.Select).
+// Without selectors all agents from the inventory file and ./agents are returned.
+// ./agents is run only if the selectors need the list of all hosts.
+func ParseRemoteAgents(selectors []string) ([]RemoteAgent, error) {
+	inv, err := loadStaticInventory()
+	if err != nil {
+		return nil, err
 	}
 
-	parse := func(s string) (*RemoteAgent, error) {
-		a := RemoteAgent{User: "root", Port: 22}
-
-		switch fields := strings.Split(s, "@"); {
-		case len(fields) == 1:
-		case len(fields) == 2:
-			a.User, s = fields[0], fields[1]
-		default:
-			return nil, fmt.Errorf("incorrect format: %s", s)
+	if inv.needsAllHosts(selectors, make(StringSet)) {
+		if err := inv.loadAgents(); err != nil {
+			return nil, err
 		}
+	}
 
-		switch fields := strings.Split(s, ":"); {
-		case len(fields) == 1:
-			a.Host = fields[0]
-		case len(fields) == 2:
-			a.Host = fields[0]
-			d, err := strconv.Atoi(fields[1])
-			if err != nil {
-				return nil, err
-			}
-			a.Port = d
-		default:
-			return nil, fmt.Errorf("incorrect format: %s", s)
-		}
+	return inv.Select(selectors)
+}
 
-		return &a, nil
-	}
+// Parses an agent in the format [user@]host[:port].
+func parseRemoteAgent(s string) (*RemoteAgent, error) {
+	a := RemoteAgent{User: "root", Port: 22}
 
-	agents := make([]RemoteAgent, 0, len(entries))
+	switch fields := strings.Split(s, "@"); {
+	case len(fields) == 1:
+	case len(fields) == 2:
+		a.User, s = fields[0], fields[1]
+	default:
+		return nil, fmt.Errorf("incorrect format: %s", s)
+	}
 
-	for _, s := range entries {
-		a, err := parse(s)
+	switch fields := strings.Split(s, ":"); {
+	case len(fields) == 1:
+		a.Host = fields[0]
+	case len(fields) == 2:
+		a.Host = fields[0]
+		d, err := strconv.Atoi(fields[1])
 		if err != nil {
 			return nil, err
 		}
-		agents = append(agents, *a)
+		a.Port = d
+	default:
+		return nil, fmt.Errorf("incorrect format: %s", s)
 	}
 
-	return agents, nil
+	return &a, nil
 }
 
-func execRemoteCmd(agents []RemoteAgent, cmd string, concurrency int, forwardAgent bool) (errors []error) {
-	authSock := os.Getenv("SSH_AUTH_SOCK")
+// Statuses of a command executed on a remote agent.
+const (
+	StatusOK          = "ok"
+	StatusFailed      = "failed"      // command exited with a non-zero status
+	StatusError       = "error"       // session failed without an exit status
+	StatusUnreachable = "unreachable" // connection failed
+	StatusTimeout     = "timeout"     // command was killed by timeout
+	StatusCanceled    = "canceled"    // command was interrupted
+	StatusSkipped     = "skipped"     // command wasn't started
+)
+
+// Type RemoteOptions describes how a command is executed on remote agents.
+type RemoteOptions struct {
+	Concurrency  int
+	ForwardAgent bool
+	JSONOutput   bool
+	// Maximum duration of a command on a single agent (no limit if 0)
+	Timeout time.Duration
+	// Stop scheduling new agents after the first failure
+	FailFast bool
+	// Print the output line by line as it arrives, with host prefixes
+	Stream bool
+	Color  bool
+	// Directory where the output and the status of each host are saved
+	OutDir string
+	// File that is passed to the command's stdin
+	Stdin string
+	// Session that is run instead of the command
+	Session RemoteSession
+}
+
+// Methods of the go-sshwrapper connection used by keeper besides NewSSHConn.
+// A version of the library without them fails the build here.
+var _ interface {
+	Run(cmd string, stdin io.Reader, stdout, stderr io.Writer) error
+	Close() error
+} = (*sshwrapper.SSHConn)(nil)
+
+// Type RemoteSession is a function that works with an established connection
+// to the agent and writes its output to stdout and stderr. It must stop
+// when the context is done.
+type RemoteSession func(ctx context.Context, conn *sshwrapper.SSHConn, stdout, stderr io.Writer) error
+
+// Type HostResult describes the result of a command executed on a remote agent.
+type HostResult struct {
+	Agent    RemoteAgent
+	Status   string
+	ExitCode int // -1 if the command hasn't returned an exit status
+	Duration time.Duration
+	Err      error
+}
+
+func (a RemoteAgent) String() string {
+	return fmt.Sprintf("%s@%s:%d", a.User, a.Host, a.Port)
+}
+
+// Returns the name of the agent's directory in the results directory:
+// the host with the user and the port if they are not the default ones,
+// so different agents on the same host don't share it.
+func (a RemoteAgent) outputName() string {
+	name := a.Host
+	if a.User != "root" {
+		name = a.User + "@" + name
+	}
+	if a.Port != 22 {
+		name += ":" + strconv.Itoa(a.Port)
+	}
+	return name
+}
+
+// Sets the status and the exit code according to the error returned by the session.
+func (r *HostResult) setRunError(err error) {
+	r.Err = err
+
+	switch e, ok := err.(interface{ ExitStatus() int }); {
+	case err == nil:
+		r.Status = StatusOK
+	case ok:
+		r.Status = StatusFailed
+		r.ExitCode = e.ExitStatus()
+	case err == context.DeadlineExceeded:
+		r.Status = StatusTimeout
+		r.ExitCode = -1
+	case err == context.Canceled:
+		r.Status = StatusCanceled
+		r.ExitCode = -1
+	default:
+		r.Status = StatusError
+		r.ExitCode = -1
+	}
+}
+
+// Returns an event that describes the result.
+func (r *HostResult) Event(cmd string, started time.Time) *RemoteEvent {
+	ev := RemoteEvent{
+		Host:     r.Agent.Host,
+		User:     r.Agent.User,
+		Port:     r.Agent.Port,
+		Command:  cmd,
+		Started:  started.Format(time.RFC3339),
+		Status:   r.Status,
+		ExitCode: r.ExitCode,
+		Duration: r.Duration.Seconds(),
+	}
+	if r.Err != nil {
+		ev.Error = r.Err.Error()
+	}
+
+	return &ev
+}
+
+// Creates the files for stdout and stderr of the agent in DIR/<host>/
+// (see RemoteAgent.outputName).
+func createHostOutput(dir string, a RemoteAgent) (*os.File, *os.File, error) {
+	hostdir := filepath.Join(dir, a.outputName())
+
+	if err := os.MkdirAll(hostdir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	fout, err := os.Create(filepath.Join(hostdir, "stdout"))
+	if err != nil {
+		return nil, nil, err
+	}
+	ferr, err := os.Create(filepath.Join(hostdir, "stderr"))
+	if err != nil {
+		fout.Close()
+		return nil, nil, err
+	}
+
+	return fout, ferr, nil
+}
+
+// Saves the status, the exit code and the duration of the command
+// into DIR/<host>/status.
+func writeHostMeta(dir string, a RemoteAgent, ev *RemoteEvent) error {
+	b, err := yaml.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, a.outputName(), "status"), b, 0644)
+}
+
+// Type guardedWriter passes writes to the underlying writer until it's closed.
+// It protects the output from a session that is abandoned by timeout.
+type guardedWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+func (g *guardedWriter) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return g.w.Write(p)
+}
+
+func (g *guardedWriter) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.closed = true
 
-	limit := make(chan struct{}, concurrency)
+	return nil
+}
+
+// Connects to the agent and runs cmd (or the session if it's defined). The connection is closed
+// when the command is finished. If the context is done before that, the connection is closed
+// to interrupt the command and the context error is returned.
+func runRemoteCmd(ctx context.Context, a RemoteAgent, cmd string, session RemoteSession, authSock string, forwardAgent bool, stdin io.Reader, stdout, stderr io.Writer) (connErr, runErr error) {
+	connCh := make(chan *sshwrapper.SSHConn, 1)
+	done := make(chan [2]error, 1)
+
+	var closeOnce sync.Once
+	closeConn := func(conn *sshwrapper.SSHConn) {
+		closeOnce.Do(func() { conn.Close() })
+	}
 
-	execute := func(user, host string, port int) error {
-		conn, err := sshwrapper.NewSSHConn(user, host, port, authSock, forwardAgent)
+	go func() {
+		conn, err := sshwrapper.NewSSHConn(a.User, a.Host, a.Port, authSock, forwardAgent)
 		if err != nil {
-			return err
+			done <- [2]error{err, nil}
+			return
+		}
+		defer closeConn(conn)
+
+		connCh <- conn
+
+		// The context may be done while connecting
+		if err := ctx.Err(); err != nil {
+			done <- [2]error{nil, err}
+			return
 		}
+		if session != nil {
+			done <- [2]error{nil, session(ctx, conn, stdout, stderr)}
+			return
+		}
+		done <- [2]error{nil, conn.Run(cmd, stdin, stdout, stderr)}
+	}()
+
+	select {
+	case res := <-done:
+		return res[0], res[1]
+	case <-ctx.Done():
+		select {
+		case conn := <-connCh:
+			closeConn(conn)
+		default:
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func execRemoteCmd(ctx context.Context, agents []RemoteAgent, cmd string, opts RemoteOptions) []HostResult {
+	authSock := os.Getenv("SSH_AUTH_SOCK")
+
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	limit := make(chan struct{}, opts.Concurrency)
+
+	// Closed on the first failure in fail-fast mode
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+
+	execute := func(idx int, a RemoteAgent) (r HostResult) {
+		r = HostResult{Agent: a, Status: StatusOK}
+
+		start := time.Now()
 
-		var output *os.File
+		// In JSON mode the output is collected into the event.
+		// In streaming mode each line is printed as it arrives.
+		// In concurrent mode the output is collected into a temporary file
+		// and printed at once when the command is finished.
+		var outBuf, errBuf bytes.Buffer
+		var tmpfile *os.File
+		var outW, errW io.Writer
+		var streams []*prefixWriter
 
 		switch {
-		case concurrency > 1:
-			tmpfile, err := ioutil.TempFile("", ".keeper_report_")
+		case opts.JSONOutput:
+			outW, errW = &outBuf, &errBuf
+		case opts.Stream:
+			o, e := newPrefixWriters(a, idx, opts.Color, os.Stdout, os.Stderr)
+			streams = append(streams, o, e)
+			outW, errW = o, e
+		case opts.Concurrency > 1:
+			f, err := ioutil.TempFile("", ".keeper_report_")
 			if err != nil {
-				return err
+				r.setRunError(err)
+				return r
 			}
-			_ = os.Remove(tmpfile.Name())
-			defer tmpfile.Close()
+			_ = os.Remove(f.Name())
+			defer f.Close()
 
-			output = tmpfile
+			tmpfile = f
+			outW, errW = f, f
 		default:
-			output = os.Stdout
+			fmt.Printf("--> %s\n", a)
+			outW, errW = os.Stdout, os.Stdout
+		}
+
+		// Besides, stdout and stderr are saved separately into the results directory
+		if opts.OutDir != "" {
+			fout, ferr, err := createHostOutput(opts.OutDir, a)
+			if err != nil {
+				r.setRunError(err)
+				return r
+			}
+			defer fout.Close()
+			defer ferr.Close()
+
+			outW, errW = io.MultiWriter(outW, fout), io.MultiWriter(errW, ferr)
+		}
+
+		stdout, stderr := &guardedWriter{w: outW}, &guardedWriter{w: errW}
+
+		hostCtx := ctx
+		if opts.Timeout > 0 {
+			var cancel context.CancelFunc
+			hostCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+			defer cancel()
 		}
 
-		if concurrency == 1 {
-			fmt.Printf("--> %s@%s:%d\n", user, host, port)
+		// Each agent reads the stdin file from the beginning
+		var stdin io.Reader
+		if opts.Stdin != "" {
+			f, err := os.Open(opts.Stdin)
+			if err != nil {
+				r.setRunError(err)
+				return r
+			}
+			defer f.Close()
+
+			stdin = f
+		}
+
+		switch connErr, runErr := runRemoteCmd(hostCtx, a, cmd, opts.Session, authSock, opts.ForwardAgent, stdin, stdout, stderr); {
+		case connErr != nil:
+			r.Status, r.ExitCode, r.Err = StatusUnreachable, -1, connErr
+		default:
+			r.setRunError(runErr)
 		}
 
-		if err := conn.Run(cmd, nil, output, output); err != nil {
-			return err
+		// The abandoned session must not write anymore
+		stdout.Close()
+		stderr.Close()
+
+		for _, pw := range streams {
+			pw.Flush()
 		}
 
-		if concurrency > 1 {
-			if err := output.Sync(); err != nil {
-				return err
+		r.Duration = time.Since(start)
+
+		ev := r.Event(cmd, start)
+
+		if opts.OutDir != "" {
+			if err := writeHostMeta(opts.OutDir, a, ev); err != nil {
+				warn(err)
 			}
-			if _, err := output.Seek(int64(os.SEEK_SET), 0); err != nil {
-				return err
+		}
+
+		switch {
+		case opts.JSONOutput:
+			ev.Output = outBuf.String()
+			ev.Stderr = errBuf.String()
+			emitEvent(ev)
+		case opts.Stream:
+		case tmpfile != nil:
+			if _, err := tmpfile.Seek(0, io.SeekStart); err != nil {
+				warn(err)
 			}
 
 			outLock.Lock()
 			defer outLock.Unlock()
 
-			fmt.Printf("--> %s@%s:%d\n", user, host, port)
-			io.Copy(os.Stdout, output)
+			fmt.Printf("--> %s\n", a)
+			io.Copy(os.Stdout, tmpfile)
+			fmt.Println()
+		default:
+			fmt.Println()
 		}
 
-		fmt.Println()
+		return r
+	}
 
-		return nil
+	results := make([]HostResult, len(agents))
+	for i, a := range agents {
+		results[i] = HostResult{Agent: a, Status: StatusSkipped, ExitCode: -1}
 	}
 
 	var wg sync.WaitGroup
 
-	for _, agent := range agents {
-		limit <- struct{}{}
+schedule:
+	for i, agent := range agents {
+		select {
+		case limit <- struct{}{}:
+		case <-ctx.Done():
+			break schedule
+		case <-stop:
+			break schedule
+		}
+
+		// The slot could be released by a failed host
+		select {
+		case <-ctx.Done():
+			break schedule
+		case <-stop:
+			break schedule
+		default:
+		}
+
 		wg.Add(1)
 
-		go func(a RemoteAgent) {
+		go func(i int, a RemoteAgent) {
 			defer wg.Done()
 			defer func() { <-limit }()
 
-			if err := execute(a.User, a.Host, a.Port); err != nil {
-				errors = append(errors, fmt.Errorf("%s: %s", a.Host, err))
+			results[i] = execute(i, a)
+
+			if opts.FailFast && results[i].Err != nil {
+				stopOnce.Do(func() { close(stop) })
 			}
-		}(agent)
+		}(i, agent)
 	}
 
 	wg.Wait()
 
-	return errors
+	return results
+}
+
+// Prints a summary table of the remote execution results.
+func printRemoteSummary(results []HostResult) {
+	fmt.Println("--> Summary:")
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, " HOST\tSTATUS\tEXIT\tDURATION")
+	for _, r := range results {
+		exitCode := "-"
+		if r.ExitCode >= 0 {
+			exitCode = strconv.Itoa(r.ExitCode)
+		}
+		fmt.Fprintf(w, " %s\t%s\t%s\t%s\n", r.Agent, r.Status, exitCode, r.Duration.Round(time.Millisecond))
+	}
+
+	w.Flush()
 }
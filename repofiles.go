@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -16,6 +17,10 @@ import (
 	"github.com/0xef53/go-group"
 )
 
+// The state of the file that must not exist in the file system:
+// "state: absent" in params or the .absent suffix of the repository file.
+const StateAbsent = "absent"
+
 // Type describes parameters of repository file.
 type RepositoryFile struct {
 	Path       string      `yaml:"-"`
@@ -25,22 +30,37 @@ type RepositoryFile struct {
 	Uid        int         `yaml:"-"`
 	Gid        int         `yaml:"-"`
 	Perms      os.FileMode `yaml:"perms"`
+	OnChange   Commands    `yaml:"on_change"`
+	Check      string      `yaml:"check"`
+	When       Condition   `yaml:"when"`
+	Marker     string      `yaml:"marker"` // block markers, {mark} is replaced with BEGIN or END
+	Edit       string      `yaml:"-"`      // block, lines or merge, see editKind
+	State      string      `yaml:"state"`  // present (default) or absent
+	Recursive  bool        `yaml:"recursive"`
 	Mode       os.FileMode `yaml:"-"`
 	IsTemplate bool        `yaml:"-"`
+	Layer      string      `yaml:"-"`
+
+	// Rendered template output
+	rendered []byte
+	// Whether the template uses secrets
+	usesSecrets bool
+	// Owner/group as they are defined in params,
+	// even if they don't exist on this host
+	cfgOwner string
+	cfgGroup string
+	// Whether owner/group are defined in params
+	ownerSet bool
+	groupSet bool
 }
 
-func NewRepositoryFile(repopath string) (*RepositoryFile, error) {
+func NewRepositoryFile(repopath string, l Layer) (*RepositoryFile, error) {
 	f := RepositoryFile{
 		Path:  repopath,
-		Owner: "root",
-		Group: "root",
+		Layer: l.Name,
 	}
 
-	f.FSPath = filepath.Join("/", strings.TrimPrefix(repopath, BASEDIR))
-	if path.Ext(f.Path) == ".template" {
-		f.IsTemplate = true
-		f.FSPath = strings.TrimSuffix(f.FSPath, ".template")
-	}
+	f.FSPath, f.IsTemplate = layerFSPath(l, repopath)
 
 	fi, err := os.Lstat(f.Path)
 	if err != nil {
@@ -48,6 +68,13 @@ func NewRepositoryFile(repopath string) (*RepositoryFile, error) {
 	}
 	f.Mode = fi.Mode()
 
+	switch {
+	case path.Ext(repopath) == "."+StateAbsent:
+		f.State = StateAbsent
+	case fi.Mode().IsRegular():
+		f.Edit, _ = editKind(strings.TrimSuffix(repopath, ".template"))
+	}
+
 	// If repopath is a file, then applying .#_globparams first and then .#FILENAME_params.
 	// If repopath is a directory, then applying only .#_params from this directory.
 	var paramsFile string
@@ -80,6 +107,24 @@ func NewRepositoryFile(repopath string) (*RepositoryFile, error) {
 		}
 	}
 
+	switch f.State {
+	case "", "present":
+	case StateAbsent:
+		f.Edit = ""
+	default:
+		return nil, fmt.Errorf("Params error: incorrect state: %s", f.State)
+	}
+
+	f.ownerSet, f.groupSet = f.Owner != "", f.Group != ""
+	if !f.ownerSet {
+		f.Owner = "root"
+	}
+	if !f.groupSet {
+		f.Group = "root"
+	}
+
+	f.cfgOwner, f.cfgGroup = f.Owner, f.Group
+
 	// Looking for UID/GID
 	switch u, err := user.Lookup(f.Owner); {
 	case err == nil:
@@ -105,73 +150,240 @@ func NewRepositoryFile(repopath string) (*RepositoryFile, error) {
 	return &f, nil
 }
 
-// Checks whether the file from repository is the same as file in the file system.
-func (rf *RepositoryFile) Exists() bool {
-	// Always overwrite template files
-	if rf.IsTemplate {
-		return false
+// Edits (see editKind) keep the mode and the owner/group of the existing file
+// in the file system unless they are defined in params.
+func (rf *RepositoryFile) keepLocalAttributes() {
+	if rf.Edit == "" {
+		return
+	}
+
+	fi, err := os.Lstat(rf.FSPath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+
+	if rf.Perms == 0 {
+		rf.Mode = fi.Mode()
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	if !rf.ownerSet {
+		rf.Uid = int(st.Uid)
+		rf.Owner = strconv.Itoa(rf.Uid)
+		if u, err := user.LookupId(rf.Owner); err == nil {
+			rf.Owner = u.Username
+		}
+		rf.cfgOwner = rf.Owner
+	}
+	if !rf.groupSet {
+		rf.Gid = int(st.Gid)
+		rf.Group = strconv.Itoa(rf.Gid)
+		if g, err := user.LookupGroupId(rf.Group); err == nil {
+			rf.Group = g.Name
+		}
+		rf.cfgGroup = rf.Group
 	}
+}
 
+// Checks whether the file from repository is the same as file in the file system.
+// Returns an error if the content of a template or an edit cannot be made.
+func (rf *RepositoryFile) Exists() (bool, error) {
 	fsfileInfo, err := os.Lstat(rf.FSPath)
+	if rf.State == StateAbsent {
+		// Absent files are the same if they don't exist
+		return os.IsNotExist(err), nil
+	}
 	if err != nil {
-		return false
+		return false, nil
 	}
 
 	// Checking attributes and owner/group IDs
 	if fsfileInfo.Mode() != rf.Mode {
-		return false
+		return false, nil
 	}
 	if fsfileInfo.Sys() == nil {
-		return false
+		return false, nil
 	}
 	fsfileUid := int(fsfileInfo.Sys().(*syscall.Stat_t).Uid)
 	fsfileGid := int(fsfileInfo.Sys().(*syscall.Stat_t).Gid)
 
 	if fsfileUid != rf.Uid || fsfileGid != rf.Gid {
-		return false
+		return false, nil
 	}
 
 	switch {
 	case rf.Mode.IsDir():
 		if !fsfileInfo.Mode().IsDir() {
-			return false
+			return false, nil
 		}
 	case rf.Mode&os.ModeSymlink != 0:
 		if fsfileInfo.Mode()&os.ModeSymlink == 0 {
-			return false
+			return false, nil
 		}
 		dest1, err := os.Readlink(rf.Path)
 		if err != nil {
-			return false
+			return false, nil
 		}
 		dest2, err := os.Readlink(rf.FSPath)
 		if err != nil {
-			return false
+			return false, nil
 		}
 		if dest1 != dest2 {
-			return false
+			return false, nil
 		}
 	case rf.Mode.IsRegular():
 		if !fsfileInfo.Mode().IsRegular() {
-			return false
+			return false, nil
+		}
+		if rf.IsTemplate || rf.Edit != "" {
+			// Templates and edits are made in memory and compared with the file content
+			content, err := rf.Content()
+			if err != nil {
+				return false, err
+			}
+			fsContent, err := ioutil.ReadFile(rf.FSPath)
+			if err != nil || !bytes.Equal(content, fsContent) {
+				return false, nil
+			}
+		} else if !equalContent(rf.Path, rf.FSPath) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Returns the content of the repository file: the rendered template
+// or the file content itself. Templates are rendered only once.
+func (rf *RepositoryFile) source() ([]byte, error) {
+	if !rf.IsTemplate {
+		return ioutil.ReadFile(rf.Path)
+	}
+	if rf.rendered == nil {
+		b, used, err := renderTemplateSecrets(rf.Path, ENVS)
+		if err != nil {
+			return nil, err
+		}
+		rf.rendered, rf.usesSecrets = b, used
+	}
+	return rf.rendered, nil
+}
+
+// Returns the content that the file in the file system should have.
+// For edits (see editKind) it is the current content with the edit applied.
+func (rf *RepositoryFile) Content() ([]byte, error) {
+	src, err := rf.source()
+	if err != nil || rf.Edit == "" {
+		return src, err
+	}
+
+	current, err := ioutil.ReadFile(rf.FSPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return rf.applyEdit(current, src)
+}
+
+// Describes the differences between the file from repository and the file
+// in the file system: attributes, owner/group, symbolic link target and
+// unified diff of the content. Returns an empty string if there are no differences.
+func (rf *RepositoryFile) Diff() (string, error) {
+	var buf bytes.Buffer
+
+	fsfileInfo, err := os.Lstat(rf.FSPath)
+
+	if rf.State == StateAbsent {
+		switch {
+		case os.IsNotExist(err):
+			return "", nil
+		case err != nil:
+			return "", err
+		}
+		fmt.Fprintf(&buf, "remove: %s\n", fsfileInfo.Mode())
+		if fsfileInfo.Mode().IsRegular() {
+			oldContent, err := ioutil.ReadFile(rf.FSPath)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString(unifiedDiff(oldContent, nil, rf.FSPath, "/dev/null"))
+		}
+		return buf.String(), nil
+	}
+
+	switch {
+	case err == nil:
+		if fsfileInfo.Mode() != rf.Mode {
+			fmt.Fprintf(&buf, "mode: %s -> %s\n", fsfileInfo.Mode(), rf.Mode)
+		}
+		if st, ok := fsfileInfo.Sys().(*syscall.Stat_t); ok {
+			if int(st.Uid) != rf.Uid || int(st.Gid) != rf.Gid {
+				fmt.Fprintf(&buf, "owner: %d:%d -> %d:%d\n", st.Uid, st.Gid, rf.Uid, rf.Gid)
+			}
+		}
+	case os.IsNotExist(err):
+		fsfileInfo = nil
+		fmt.Fprintf(&buf, "new: %s %d:%d\n", rf.Mode, rf.Uid, rf.Gid)
+	default:
+		return "", err
+	}
+
+	switch {
+	case rf.Mode&os.ModeSymlink != 0:
+		newDest, err := os.Readlink(rf.Path)
+		if err != nil {
+			return "", err
 		}
-		if !equalContent(rf.Path, rf.FSPath) {
-			return false
+		var oldDest string
+		if fsfileInfo != nil && fsfileInfo.Mode()&os.ModeSymlink != 0 {
+			if oldDest, err = os.Readlink(rf.FSPath); err != nil {
+				return "", err
+			}
+		}
+		if oldDest != newDest {
+			fmt.Fprintf(&buf, "symlink: %q -> %q\n", oldDest, newDest)
+		}
+	case rf.Mode.IsRegular():
+		newContent, err := rf.Content()
+		if err != nil {
+			return "", err
+		}
+		var oldContent []byte
+		if fsfileInfo != nil && fsfileInfo.Mode().IsRegular() {
+			if oldContent, err = ioutil.ReadFile(rf.FSPath); err != nil {
+				return "", err
+			}
+		}
+		switch {
+		case bytes.Equal(oldContent, newContent):
+		case rf.usesSecrets && !SHOW_SECRETS:
+			// Secrets may be in any form, so the content is not printed at all
+			buf.WriteString("content: changed (hidden, the template uses secrets, see -show-secrets)\n")
+		default:
+			buf.WriteString(unifiedDiff(oldContent, newContent, rf.FSPath, rf.Layer+rf.FSPath))
 		}
 	}
-	return true
+
+	return buf.String(), nil
 }
 
 // Syncs the file/directory from repository to the file system
 // and sets the access attributes and the owner/group.
 func (rf *RepositoryFile) Sync() error {
 	switch {
+	case rf.State == StateAbsent:
+		return rf.remove()
 	case rf.Mode.IsDir():
 		switch dfi, err := os.Stat(rf.FSPath); {
 		case err == nil:
 			if !(dfi.Mode().IsDir()) {
 				return fmt.Errorf("non directory destination already exists: %s (%q)", rf.FSPath, dfi.Mode().String())
 			}
+			if err := backupFile(rf.FSPath); err != nil {
+				return err
+			}
 		case !os.IsNotExist(err):
 			return err
 		}
@@ -191,6 +403,9 @@ func (rf *RepositoryFile) Sync() error {
 			if dfi.Mode()&os.ModeSymlink == 0 {
 				return fmt.Errorf("non symbolic link destination file already exists: %s", rf.FSPath)
 			}
+			if err := backupFile(rf.FSPath); err != nil {
+				return err
+			}
 			if err := os.Remove(rf.FSPath); err != nil {
 				return err
 			}
@@ -211,16 +426,23 @@ func (rf *RepositoryFile) Sync() error {
 			if !(dfi.Mode().IsRegular()) {
 				return fmt.Errorf("non regular destination file already exists: %s (%q)", rf.FSPath, dfi.Mode().String())
 			}
+			if err := backupFile(rf.FSPath); err != nil {
+				return err
+			}
 		case !os.IsNotExist(err):
 			return err
 		}
 
-		if rf.IsTemplate {
-			if err := executeTemplate(rf.Path, rf.FSPath, rf.Mode, rf.Uid, rf.Gid); err != nil {
+		if rf.IsTemplate || rf.Edit != "" {
+			content, err := rf.Content()
+			if err != nil {
+				return err
+			}
+			if err := writeFileContents(bytes.NewReader(content), rf.FSPath, rf.Mode, rf.Uid, rf.Gid, rf.Check); err != nil {
 				return err
 			}
 		} else {
-			if err := copyFileContents(rf.Path, rf.FSPath, rf.Mode, rf.Uid, rf.Gid); err != nil {
+			if err := copyFileContents(rf.Path, rf.FSPath, rf.Mode, rf.Uid, rf.Gid, rf.Check); err != nil {
 				return err
 			}
 		}
@@ -229,10 +451,51 @@ func (rf *RepositoryFile) Sync() error {
 	return nil
 }
 
+// Removes the file/directory from the file system saving it into the backup run.
+// Non-empty directories are removed only with the recursive parameter.
+func (rf *RepositoryFile) remove() error {
+	fi, err := os.Lstat(rf.FSPath)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if fi.IsDir() {
+		switch entries, err := ioutil.ReadDir(rf.FSPath); {
+		case err != nil:
+			return err
+		case len(entries) > 0 && !rf.Recursive:
+			return fmt.Errorf("directory not empty so not removed (see the recursive parameter): %s", rf.FSPath)
+		}
+	}
+
+	err = filepath.Walk(rf.FSPath, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return backupFile(p)
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(rf.FSPath)
+}
+
 func (rf RepositoryFile) String() string {
+	if rf.State == StateAbsent {
+		return fmt.Sprintf(" x %s%s  ->  %s (absent)", rf.Layer, rf.FSPath, rf.FSPath)
+	}
+
 	tplMark := "-"
-	if rf.IsTemplate {
+	switch {
+	case rf.Edit != "":
+		// b or l
+		tplMark = rf.Edit[:1]
+	case rf.IsTemplate:
 		tplMark = "t"
 	}
-	return fmt.Sprintf(" %s %s %s:%s base%s  ->  %s", tplMark, rf.Mode, rf.Owner, rf.Group, rf.FSPath, rf.FSPath)
+	return fmt.Sprintf(" %s %s %s:%s %s%s  ->  %s", tplMark, rf.Mode, rf.Owner, rf.Group, rf.Layer, rf.FSPath, rf.FSPath)
 }
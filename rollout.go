@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Host has passed the command but has failed the health check.
+const StatusUnhealthy = "unhealthy"
+
+// Type RolloutStrategy describes how a command is rolled out to the agents
+// batch by batch: the canary hosts first and then the rest.
+type RolloutStrategy struct {
+	// Number of hosts in the first batch. Any failure there stops the rollout
+	Canary int
+	// Batch size: absolute or in percent of all hosts
+	BatchSize    int
+	BatchPercent float64
+	// Pause between batches
+	Pause time.Duration
+	// Command that is run on the hosts of a completed batch
+	HealthCheck string
+	// The rollout stops when the ratio of failed hosts exceeds this value
+	MaxFailRatio float64
+}
+
+// Parses a number that can be defined in percent, e.g. "10" or "25%".
+// Returns the number and true if it was defined in percent.
+func parsePercent(s string) (float64, bool, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasSuffix(s, "%") {
+		v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil {
+			return 0, false, err
+		}
+		return v, true, nil
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+
+	return v, false, err
+}
+
+// Makes a rollout strategy from the command line options.
+// Returns nil if no batching options are defined. Other rollout options
+// are not allowed without them.
+func parseRolloutStrategy(canary int, batch string, pause time.Duration, healthCheck, maxFail string) (*RolloutStrategy, error) {
+	if canary < 0 {
+		return nil, fmt.Errorf("number of canary hosts must not be negative: %d", canary)
+	}
+
+	if canary == 0 && batch == "" {
+		if pause != 0 || healthCheck != "" || maxFail != "" {
+			return nil, fmt.Errorf("-pause, -health-check and -max-fail require -canary or -batch")
+		}
+		return nil, nil
+	}
+
+	s := RolloutStrategy{
+		Canary:      canary,
+		Pause:       pause,
+		HealthCheck: healthCheck,
+	}
+
+	if batch != "" {
+		v, percent, err := parsePercent(batch)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("incorrect batch size: %s", batch)
+		case v <= 0:
+			return nil, fmt.Errorf("batch size must be positive: %s", batch)
+		case percent:
+			s.BatchPercent = v
+		case v != math.Trunc(v):
+			return nil, fmt.Errorf("batch size must be an integer number of hosts: %s", batch)
+		default:
+			s.BatchSize = int(v)
+		}
+	}
+
+	if maxFail != "" {
+		v, percent, err := parsePercent(maxFail)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect failure threshold: %s", maxFail)
+		}
+		if percent {
+			v /= 100
+		}
+		if v < 0 || v > 1 {
+			return nil, fmt.Errorf("failure threshold must be between 0 and 1 (or 0%% and 100%%): %s", maxFail)
+		}
+		s.MaxFailRatio = v
+	}
+
+	return &s, nil
+}
+
+// Splits the agents into batches: canary hosts and then batches of the defined size.
+// Without batch size all the rest hosts are in one batch.
+func (s *RolloutStrategy) batches(agents []RemoteAgent) [][]RemoteAgent {
+	var batches [][]RemoteAgent
+
+	if s.Canary > 0 && len(agents) > 0 {
+		n := s.Canary
+		if n > len(agents) {
+			n = len(agents)
+		}
+		batches = append(batches, agents[:n])
+		agents = agents[n:]
+	}
+
+	size := s.BatchSize
+	if s.BatchPercent > 0 {
+		size = int(math.Ceil(float64(len(agents)) * s.BatchPercent / 100))
+	}
+	if size <= 0 {
+		size = len(agents)
+	}
+
+	for len(agents) > 0 {
+		n := size
+		if n > len(agents) {
+			n = len(agents)
+		}
+		batches = append(batches, agents[:n])
+		agents = agents[n:]
+	}
+
+	return batches
+}
+
+// Runs cmd on the agents batch by batch according to the strategy.
+// The hosts of the batches that haven't been started are marked as skipped.
+func rolloutRemoteCmd(ctx context.Context, agents []RemoteAgent, cmd string, opts RemoteOptions, s *RolloutStrategy) []HostResult {
+	results := make([]HostResult, 0, len(agents))
+
+	batches := s.batches(agents)
+
+	var processed, failed int
+
+	for i, batch := range batches {
+		canary := i == 0 && s.Canary > 0
+
+		if i > 0 && s.Pause > 0 {
+			textf("--> Pause %s\n\n", s.Pause)
+			select {
+			case <-time.After(s.Pause):
+			case <-ctx.Done():
+			}
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		switch {
+		case canary:
+			textf("--> Batch %d/%d (canary): %d host(s)\n\n", i+1, len(batches), len(batch))
+		default:
+			textf("--> Batch %d/%d: %d host(s)\n\n", i+1, len(batches), len(batch))
+		}
+
+		batchResults := execRemoteCmd(ctx, batch, cmd, opts)
+
+		if s.HealthCheck != "" {
+			checkHealth(ctx, batchResults, s.HealthCheck, opts)
+		}
+
+		var batchFailed int
+		for _, r := range batchResults {
+			if r.Status == StatusSkipped {
+				continue
+			}
+			processed++
+			if r.Err != nil {
+				batchFailed++
+			}
+		}
+		failed += batchFailed
+
+		results = append(results, batchResults...)
+
+		if batchFailed == 0 {
+			continue
+		}
+
+		ratio := float64(failed) / float64(processed)
+
+		switch {
+		case canary:
+			warn("canary batch failed, stopping the rollout")
+		case opts.FailFast:
+			warn("batch failed, stopping the rollout")
+		case ratio > s.MaxFailRatio:
+			warn(fmt.Sprintf("failure ratio %.2f exceeds %.2f, stopping the rollout", ratio, s.MaxFailRatio))
+		default:
+			continue
+		}
+
+		break
+	}
+
+	// The rest of hosts were not started
+	for _, a := range agents[len(results):] {
+		results = append(results, HostResult{Agent: a, Status: StatusSkipped, ExitCode: -1})
+	}
+
+	return results
+}
+
+// Runs the health check command on the hosts that have completed the rollout command
+// successfully. The hosts that fail the check are marked as unhealthy.
+func checkHealth(ctx context.Context, results []HostResult, healthCheck string, opts RemoteOptions) {
+	var agents []RemoteAgent
+	var idx []int
+
+	for i, r := range results {
+		if r.Err == nil && r.Status == StatusOK {
+			agents = append(agents, r.Agent)
+			idx = append(idx, i)
+		}
+	}
+
+	if len(agents) == 0 {
+		return
+	}
+
+	textf("--> Health check: %s\n\n", healthCheck)
+
+	opts.FailFast = false
+	opts.Stdin = ""
+	// The saved results of the rollout command must not be overwritten
+	opts.OutDir = ""
+
+	for j, hr := range execRemoteCmd(ctx, agents, healthCheck, opts) {
+		if hr.Err == nil {
+			continue
+		}
+		r := &results[idx[j]]
+		r.Status = StatusUnhealthy
+		r.ExitCode = hr.ExitCode
+		r.Err = fmt.Errorf("health check failed: %s", hr.Err)
+	}
+}
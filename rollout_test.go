@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testAgents(n int) []RemoteAgent {
+	agents := make([]RemoteAgent, n)
+	for i := range agents {
+		agents[i] = RemoteAgent{User: "root", Host: fmt.Sprintf("host%d", i+1), Port: 22}
+	}
+	return agents
+}
+
+func TestRolloutBatches(t *testing.T) {
+	tests := []struct {
+		canary int
+		batch  string
+		hosts  int
+		want   []int // sizes of the batches
+	}{
+		{canary: 1, hosts: 5, want: []int{1, 4}},
+		{canary: 2, batch: "2", hosts: 7, want: []int{2, 2, 2, 1}},
+		{batch: "3", hosts: 6, want: []int{3, 3}},
+		{batch: "25%", hosts: 10, want: []int{3, 3, 3, 1}},
+		{canary: 1, batch: "50%", hosts: 5, want: []int{1, 2, 2}},
+		{batch: "0.5%", hosts: 3, want: []int{1, 1, 1}},
+		{batch: "200%", hosts: 3, want: []int{3}},
+		{canary: 10, hosts: 3, want: []int{3}},
+		{canary: 1, batch: "2", hosts: 0, want: nil},
+	}
+
+	for _, tt := range tests {
+		s, err := parseRolloutStrategy(tt.canary, tt.batch, 0, "", "")
+		if err != nil {
+			t.Errorf("canary=%d batch=%q: unexpected error: %s", tt.canary, tt.batch, err)
+			continue
+		}
+
+		agents := testAgents(tt.hosts)
+
+		var sizes []int
+		var all []RemoteAgent
+		for _, b := range s.batches(agents) {
+			sizes = append(sizes, len(b))
+			all = append(all, b...)
+		}
+		if !reflect.DeepEqual(sizes, tt.want) {
+			t.Errorf("canary=%d batch=%q hosts=%d: got batches %v, want %v", tt.canary, tt.batch, tt.hosts, sizes, tt.want)
+		}
+		if len(agents) > 0 && !reflect.DeepEqual(all, agents) {
+			t.Errorf("canary=%d batch=%q hosts=%d: batches don't keep the order of hosts", tt.canary, tt.batch, tt.hosts)
+		}
+	}
+}
+
+func TestParseRolloutStrategy(t *testing.T) {
+	s, err := parseRolloutStrategy(0, "", 0, "", "")
+	if err != nil || s != nil {
+		t.Errorf("no options: got %v, %v, want nil strategy", s, err)
+	}
+
+	s, err = parseRolloutStrategy(1, "10", time.Minute, "true", "25%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RolloutStrategy{Canary: 1, BatchSize: 10, Pause: time.Minute, HealthCheck: "true", MaxFailRatio: 0.25}
+	if *s != want {
+		t.Errorf("got %+v, want %+v", *s, want)
+	}
+
+	if s, _ := parseRolloutStrategy(0, "1", 0, "", "0.1"); s == nil || s.MaxFailRatio != 0.1 {
+		t.Errorf("max-fail 0.1: got %+v", s)
+	}
+}
+
+func TestParseRolloutStrategyErrors(t *testing.T) {
+	tests := []struct {
+		canary      int
+		batch       string
+		pause       time.Duration
+		healthCheck string
+		maxFail     string
+	}{
+		// Rollout options without batching
+		{pause: time.Second},
+		{healthCheck: "true"},
+		{maxFail: "0.1"},
+		{canary: -1},
+		{batch: "x"},
+		{batch: "0"},
+		{batch: "-2"},
+		{batch: "0.5"},
+		{batch: "0%"},
+		{batch: "2", maxFail: "x"},
+		{batch: "2", maxFail: "-1"},
+		{batch: "2", maxFail: "1.5"},
+		{batch: "2", maxFail: "150%"},
+		{batch: "2", maxFail: "-5%"},
+	}
+
+	for _, tt := range tests {
+		if s, err := parseRolloutStrategy(tt.canary, tt.batch, tt.pause, tt.healthCheck, tt.maxFail); err == nil {
+			t.Errorf("%+v: expected an error, got %+v", tt, s)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/yaml.v2"
+)
+
+// Secret files SECRETS_DIR/NAME.box are YAML documents encrypted for all
+// public keys listed in SECRETS_DIR/recipients. The document is encrypted
+// with a random key (NaCl secretbox) and this key is sealed for each
+// recipient (NaCl anonymous box), so any recipient's private key opens it.
+//
+// The file format is:
+//
+//	keeper-secret v1
+//	recipient PUBLIC_KEY SEALED_KEY
+//	...
+//	data NONCE_AND_CIPHERTEXT
+//
+// All binary values are base64 encoded.
+const secretHeader = "keeper-secret v1"
+
+var (
+	secretsLock sync.Mutex
+	// Decrypted secret files by name and the errors of the files that cannot be decrypted
+	secretsCache  = make(map[string]interface{})
+	secretsErrors = make(map[string]error)
+)
+
+// Type secretsConfig describes the host-local settings in KEEPER_SYSDIR/secrets.yaml.
+type secretsConfig struct {
+	// Path of the private key of this host
+	KeyFile string `yaml:"key_file"`
+}
+
+// Returns the path of the private key: key_file from KEEPER_SYSDIR/secrets.yaml
+// or KEEPER_SYSDIR/secret.key by default.
+func secretKeyFile() (string, error) {
+	cfg := secretsConfig{
+		KeyFile: path.Join(KEEPER_SYSDIR, "secret.key"),
+	}
+
+	fname := path.Join(KEEPER_SYSDIR, "secrets.yaml")
+
+	switch c, err := ioutil.ReadFile(fname); {
+	case err == nil:
+		if err := yaml.Unmarshal(c, &cfg); err != nil {
+			return "", fmt.Errorf("%s: %s", fname, err)
+		}
+	case !os.IsNotExist(err):
+		return "", err
+	}
+
+	return cfg.KeyFile, nil
+}
+
+func encodeKey(key *[32]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+func decodeKey(s string) (*[32]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("incorrect key: %s", s)
+	}
+
+	var key [32]byte
+	copy(key[:], b)
+
+	return &key, nil
+}
+
+// Reads the private key of this host and returns the key pair.
+func readSecretKey() (*[32]byte, *[32]byte, error) {
+	fname, err := secretKeyFile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("secret key: %s", err)
+	}
+
+	priv, err := decodeKey(string(c))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", fname, err)
+	}
+
+	var pub [32]byte
+	curve25519.ScalarBaseMult(&pub, priv)
+
+	return &pub, priv, nil
+}
+
+// Generates a new key pair, saves the private key and returns the public one.
+func generateSecretKey() (string, error) {
+	fname, err := secretKeyFile()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(fname); err == nil {
+		return "", fmt.Errorf("secret key already exists: %s", fname)
+	}
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(path.Dir(fname), 0700); err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, encodeKey(priv)); err != nil {
+		return "", err
+	}
+
+	return encodeKey(pub), f.Close()
+}
+
+// Returns the public keys from SECRETS_DIR/recipients. Each line contains
+// a key and an optional comment, lines starting with "#" are ignored.
+func readRecipients() ([]*[32]byte, error) {
+	fname := path.Join(SECRETS_DIR, "recipients")
+
+	c, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*[32]byte
+
+	for _, line := range strings.Split(string(c), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key, err := decodeKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fname, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no recipients", fname)
+	}
+
+	return keys, nil
+}
+
+// Encrypts the data for given recipients.
+func encryptSecret(data []byte, recipients []*[32]byte) ([]byte, error) {
+	var key [32]byte
+	var nonce [24]byte
+
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintln(&buf, secretHeader)
+
+	for _, pub := range recipients {
+		sealed, err := box.SealAnonymous(nil, key[:], pub, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "recipient %s %s\n", encodeKey(pub), base64.StdEncoding.EncodeToString(sealed))
+	}
+
+	ciphertext := secretbox.Seal(nonce[:], data, &nonce, &key)
+
+	fmt.Fprintf(&buf, "data %s\n", base64.StdEncoding.EncodeToString(ciphertext))
+
+	return buf.Bytes(), nil
+}
+
+// Decrypts the data with a given key pair.
+func decryptSecret(c []byte, pub, priv *[32]byte) ([]byte, error) {
+	s := bufio.NewScanner(bytes.NewReader(c))
+	s.Buffer(nil, len(c)+1)
+
+	if !s.Scan() || s.Text() != secretHeader {
+		return nil, fmt.Errorf("unknown format")
+	}
+
+	var key *[32]byte
+	var ciphertext []byte
+
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		switch {
+		case len(fields) == 3 && fields[0] == "recipient":
+			if key != nil || fields[1] != encodeKey(pub) {
+				continue
+			}
+			sealed, err := base64.StdEncoding.DecodeString(fields[2])
+			if err != nil {
+				return nil, err
+			}
+			b, ok := box.OpenAnonymous(nil, sealed, pub, priv)
+			if !ok || len(b) != 32 {
+				return nil, fmt.Errorf("cannot open the sealed key")
+			}
+			key = new([32]byte)
+			copy(key[:], b)
+		case len(fields) == 2 && fields[0] == "data":
+			b, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			ciphertext = b
+		}
+	}
+
+	switch {
+	case key == nil:
+		return nil, fmt.Errorf("not encrypted for this host's key %s", encodeKey(pub))
+	case len(ciphertext) < 24:
+		return nil, fmt.Errorf("no data")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], ciphertext)
+
+	data, ok := secretbox.Open(nil, ciphertext[24:], &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("decryption failed")
+	}
+
+	return data, nil
+}
+
+// Checks whether the secret file is encrypted for a different list of recipients.
+func recipientsChanged(fname string) (bool, error) {
+	recipients, err := readRecipients()
+	if err != nil {
+		return false, err
+	}
+
+	c, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return false, err
+	}
+
+	current := make(StringSet)
+	for _, line := range strings.Split(string(c), "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "recipient" {
+			current.Add(fields[1])
+		}
+	}
+
+	if len(current) != len(recipients) {
+		return true, nil
+	}
+	for _, pub := range recipients {
+		if !current.Has(encodeKey(pub)) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Returns the path of a secret file with a given name.
+func secretFile(name string) (string, error) {
+	if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("incorrect secret name: %q", name)
+	}
+	return path.Join(SECRETS_DIR, name+".box"), nil
+}
+
+// Decrypts a secret file with the local key.
+func readSecret(fname string) ([]byte, error) {
+	pub, priv, err := readSecretKey()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := decryptSecret(c, pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+
+	return data, nil
+}
+
+// Validates the YAML document, encrypts it for all recipients and saves to fname.
+func writeSecret(fname string, data []byte) error {
+	var v map[string]interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("incorrect YAML document: %s", err)
+	}
+
+	recipients, err := readRecipients()
+	if err != nil {
+		return err
+	}
+
+	c, err := encryptSecret(data, recipients)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(fname), 0755); err != nil {
+		return err
+	}
+
+	return writeFileContents(bytes.NewReader(c), fname, 0644, os.Getuid(), os.Getgid(), "")
+}
+
+// Decrypts the secret file with a given name once. A file that cannot be
+// decrypted breaks only the templates that use it.
+func loadSecret(name string) (interface{}, error) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	if v, ok := secretsCache[name]; ok {
+		return v, nil
+	}
+	if err, ok := secretsErrors[name]; ok {
+		return nil, err
+	}
+
+	v, err := decodeSecret(name)
+	if err != nil {
+		secretsErrors[name] = err
+		return nil, err
+	}
+	secretsCache[name] = v
+
+	return v, nil
+}
+
+func decodeSecret(name string) (interface{}, error) {
+	fname, err := secretFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(fname); os.IsNotExist(err) {
+		return nil, fmt.Errorf("secret not found: %s", name)
+	}
+
+	data, err := readSecret(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var v map[string]interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+
+	return normalizeValue(v), nil
+}
+
+// Returns the secrets keyed by the file name: {{ .Secrets.db.password }}.
+// The files that cannot be decrypted are missing here,
+// {{ secret "db.password" }} reports the error instead.
+func (v *Variables) Secrets() (map[string]interface{}, error) {
+	if v.secretsUsed != nil {
+		*v.secretsUsed = true
+	}
+
+	files, err := filepath.Glob(path.Join(SECRETS_DIR, "*.box"))
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]interface{}, len(files))
+
+	for _, fname := range files {
+		name := strings.TrimSuffix(path.Base(fname), ".box")
+		if x, err := loadSecret(name); err == nil {
+			secrets[name] = x
+		}
+	}
+
+	return secrets, nil
+}
+
+// Returns the secret value by a dot-separated path: {{ secret "db.password" }}.
+// Only the secret file of the first path element is decrypted.
+func getSecret(name string) (interface{}, error) {
+	keys := strings.Split(name, ".")
+
+	v, err := loadSecret(keys[0])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys[1:] {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("secret not found: %s", name)
+		}
+		if v, ok = m[key]; !ok {
+			return nil, fmt.Errorf("secret not found: %s", name)
+		}
+	}
+
+	return v, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ANSI colors that are assigned to hosts in turn.
+var hostColors = []int{32, 33, 34, 35, 36, 92, 93, 94, 95, 96}
+
+// Type prefixWriter writes each complete line to the underlying writer
+// with a prefix. An incomplete line is kept until the next write or Flush.
+// Lines are written under a shared lock, so lines of different hosts don't mix.
+type prefixWriter struct {
+	mu     sync.Locker
+	w      io.Writer
+	prefix string
+	// Format of the line body, e.g. to color it
+	format string
+	buf    []byte
+}
+
+// Returns a pair of line writers for stdout and stderr of a given agent.
+// The idx is used to choose a color for the host.
+func newPrefixWriters(a RemoteAgent, idx int, color bool, stdout, stderr io.Writer) (*prefixWriter, *prefixWriter) {
+	prefix := fmt.Sprintf("[%s] ", a.Host)
+	outFormat, errFormat := "%s", "%s"
+
+	if color {
+		prefix = fmt.Sprintf("\033[%dm[%s]\033[0m ", hostColors[idx%len(hostColors)], a.Host)
+		// Stderr lines are red
+		errFormat = "\033[31m%s\033[0m"
+	}
+
+	return &prefixWriter{mu: &outLock, w: stdout, prefix: prefix, format: outFormat},
+		&prefixWriter{mu: &outLock, w: stderr, prefix: prefix, format: errFormat}
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := pw.writeLine(pw.buf[:i]); err != nil {
+			return 0, err
+		}
+		pw.buf = pw.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Writes the rest of incomplete line.
+func (pw *prefixWriter) Flush() error {
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	defer func() { pw.buf = nil }()
+
+	return pw.writeLine(pw.buf)
+}
+
+func (pw *prefixWriter) writeLine(line []byte) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	_, err := fmt.Fprintf(pw.w, "%s"+pw.format+"\n", pw.prefix, line)
+
+	return err
+}
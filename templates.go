@@ -1,9 +1,10 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"os"
 	"os/exec"
@@ -15,8 +16,13 @@ import (
 
 var (
 	funcMap = template.FuncMap{
-		"byIfname": getIfaceByName,
-		"ifelse":   ternariusIf,
+		"byIfname":    getIfaceByName,
+		"ifelse":      ternariusIf,
+		"cidrHost":    cidrHost,
+		"cidrNetmask": cidrNetmask,
+		"inSubnet":    inSubnet,
+		"firstIP4":    firstIP4,
+		"secret":      getSecret,
 	}
 
 	ENVS = new(Variables)
@@ -27,7 +33,13 @@ type CustomVariables map[string]interface{}
 type Variables struct {
 	Hostname string
 	Network  []NetIf
-	X        CustomVariables
+	Facts    Facts
+	// Inventory labels of the host
+	Labels map[string]string
+	X      CustomVariables
+
+	// Set to true when .Secrets is used
+	secretsUsed *bool
 }
 
 // Making the Variables structure.
@@ -48,55 +60,118 @@ func initVariables() error {
 		return err
 	}
 
+	switch f, err := getFacts(ENVS.Hostname); {
+	case err == nil:
+		ENVS.Facts = *f
+	default:
+		return err
+	}
+
+	var myenvs []byte
+
 	switch out, err := exec.Command("./myenvs").Output(); {
 	case err == nil:
-		if err := json.Unmarshal(out, &ENVS.X); err != nil {
-			return err
-		}
+		myenvs = out
 	case !os.IsNotExist(err):
 		return fmt.Errorf("%s: %s", err, out)
 	}
 
-	return nil
-}
+	labels, err := hostLabels(ENVS.Hostname, ENVS.Facts.FQDN)
+	if err != nil {
+		return err
+	}
+	ENVS.Labels = labels
 
-// Executes a given template tplname. On success writes results to dstname
-// if it's defined or writes to the standard output otherwise.
-func executeTemplate(tplname, dstname string, mode os.FileMode, uid, gid int) error {
-	T, err := template.New("main").Option("missingkey=error").Funcs(funcMap).ParseFiles(tplname)
+	x, err := loadCustomVariables(ENVS.Hostname, ENVS.Facts.FQDN, myenvs)
 	if err != nil {
 		return err
 	}
+	ENVS.X = x
 
-	var dstfile *os.File
-	if dstname != "" {
-		tmpfile, err := ioutil.TempFile(filepath.Dir(dstname), "keeper")
-		if err != nil {
-			return err
-		}
-		defer tmpfile.Close()
-		defer os.Remove(tmpfile.Name())
+	return nil
+}
+
+// Executes a given template tplname with given variables and returns the result.
+func renderTemplateWith(tplname string, vars *Variables) ([]byte, error) {
+	b, _, err := renderTemplateSecrets(tplname, vars)
+	return b, err
+}
+
+// Same as renderTemplateWith, but also returns true if the template
+// has used secrets: the secret function or .Secrets.
+func renderTemplateSecrets(tplname string, vars *Variables) ([]byte, bool, error) {
+	used := false
+
+	// The copy of variables tracks the use of .Secrets
+	v := *vars
+	v.secretsUsed = &used
+
+	T := template.New("main").Option("missingkey=error").Funcs(funcMap)
 
-		dstfile = tmpfile
-	} else {
-		dstfile = os.Stdout
+	// Executes a named template and returns the result,
+	// so it can be piped: {{ include "snippets/upstreams" . | indent 4 }}
+	T.Funcs(template.FuncMap{
+		"include": func(name string, data interface{}) (string, error) {
+			var buf bytes.Buffer
+			if err := T.ExecuteTemplate(&buf, name, data); err != nil {
+				return "", err
+			}
+			return buf.String(), nil
+		},
+		"secret": func(name string) (interface{}, error) {
+			used = true
+			return getSecret(name)
+		},
+	})
+
+	if err := loadPartials(T); err != nil {
+		return nil, false, err
 	}
 
-	if err := T.ExecuteTemplate(dstfile, path.Base(tplname), ENVS); err != nil {
-		return err
+	if _, err := T.ParseFiles(tplname); err != nil {
+		return nil, false, err
 	}
-	if err := dstfile.Close(); err != nil {
-		return err
+
+	var buf bytes.Buffer
+
+	if err := T.ExecuteTemplate(&buf, path.Base(tplname), &v); err != nil {
+		return nil, false, err
 	}
 
-	if dstname != "" {
-		if err := os.Chmod(dstfile.Name(), mode); err != nil {
-			return err
+	return buf.Bytes(), used, nil
+}
+
+// Parses the files from PARTIALS_DIRS as associated templates of T. Each file
+// is available by its relative path without extension, e.g. "snippets/upstreams"
+// for templates/snippets/upstreams.tpl, as well as all definitions in it.
+func loadPartials(T *template.Template) error {
+	for _, dir := range PARTIALS_DIRS {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
 		}
-		if err := os.Chown(dstfile.Name(), uid, gid); err != nil {
+
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+
+			c, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+
+			_, err = T.New(strings.TrimSuffix(rel, path.Ext(rel))).Parse(string(c))
+
+			return err
+		})
+		if err != nil {
 			return err
 		}
-		return os.Rename(dstfile.Name(), dstname)
 	}
 
 	return nil
@@ -107,7 +182,73 @@ type NetIf struct {
 	Index    int
 	Name     string
 	Hwaddr   string
+	MTU      int
+	Flags    []string // up, broadcast, loopback, pointtopoint, multicast, running
 	IP4Addrs []string
+	IP6Addrs []string // with prefix length, e.g. 2001:db8::1/64
+	Addrs    []IfAddr // addresses of both families
+}
+
+// Type IfAddr represents an address assigned to a network interface.
+type IfAddr struct {
+	Family    string // inet or inet6
+	IP        string
+	PrefixLen int
+	CIDR      string // e.g. 192.168.1.10/24
+	Network   string // e.g. 192.168.1.0/24
+	Netmask   string // IPv4 only
+	Broadcast string // IPv4 only, empty for /31 and /32 networks
+}
+
+// Returns a new interface with empty lists.
+func newNetIf(index int, name string) NetIf {
+	return NetIf{
+		Index:    index,
+		Name:     name,
+		Flags:    []string{},
+		IP4Addrs: []string{},
+		IP6Addrs: []string{},
+		Addrs:    []IfAddr{},
+	}
+}
+
+// Adds an address to the interface.
+func (iface *NetIf) addAddr(ipnet *net.IPNet) {
+	ip, mask := ipnet.IP, ipnet.Mask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+	}
+
+	ones, bits := mask.Size()
+
+	a := IfAddr{
+		IP:        ip.String(),
+		PrefixLen: ones,
+		CIDR:      (&net.IPNet{IP: ip, Mask: mask}).String(),
+		Network:   (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String(),
+	}
+
+	switch {
+	case len(ip) == net.IPv4len:
+		a.Family = "inet"
+		a.Netmask = net.IP(mask).String()
+		if bits-ones > 1 {
+			bcast := make(net.IP, len(ip))
+			for i := range ip {
+				bcast[i] = ip[i] | ^mask[i]
+			}
+			a.Broadcast = bcast.String()
+		}
+		iface.IP4Addrs = append(iface.IP4Addrs, a.IP)
+	default:
+		a.Family = "inet6"
+		iface.IP6Addrs = append(iface.IP6Addrs, a.CIDR)
+	}
+
+	iface.Addrs = append(iface.Addrs, a)
 }
 
 // Returns a list of the system's network interfaces and their parameters.
@@ -124,19 +265,20 @@ func getNetIfaces() ([]NetIf, error) {
 			return nil, err
 		}
 
-		ip4addrs := []string{}
+		x := newNetIf(iface.Index, iface.Name)
+		x.Hwaddr = iface.HardwareAddr.String()
+		x.MTU = iface.MTU
+		if iface.Flags != 0 {
+			x.Flags = strings.Split(iface.Flags.String(), "|")
+		}
+
 		for _, addr := range addrs {
-			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
-				ip4addrs = append(ip4addrs, ipnet.IP.String())
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				x.addAddr(ipnet)
 			}
 		}
 
-		iflist = append(iflist, NetIf{
-			iface.Index,
-			iface.Name,
-			iface.HardwareAddr.String(),
-			ip4addrs,
-		})
+		iflist = append(iflist, x)
 	}
 
 	return iflist, nil
@@ -152,6 +294,74 @@ func getIfaceByName(ifaces []NetIf, ifname string) NetIf {
 	return NetIf{}
 }
 
+// Returns the first IPv4 address of the interface or an empty string.
+func firstIP4(iface NetIf) string {
+	if len(iface.IP4Addrs) > 0 {
+		return iface.IP4Addrs[0]
+	}
+	return ""
+}
+
+// Returns the address with a given host number in the network prefix,
+// e.g. cidrHost "10.1.2.0/24" 5 is 10.1.2.5. Negative numbers are counted
+// from the end of the network: -1 is the last address.
+func cidrHost(prefix string, hostnum int) (string, error) {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return "", err
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+
+	n := big.NewInt(int64(hostnum))
+	if hostnum < 0 {
+		n.Add(n, size)
+	}
+	if n.Sign() < 0 || n.Cmp(size) >= 0 {
+		return "", fmt.Errorf("prefix %s has no host number %d", prefix, hostnum)
+	}
+
+	x := new(big.Int).SetBytes(ipnet.IP)
+	b := x.Add(x, n).Bytes()
+
+	ip := make(net.IP, len(ipnet.IP))
+	copy(ip[len(ip)-len(b):], b)
+
+	return ip.String(), nil
+}
+
+// Returns the netmask of an IPv4 network prefix, e.g. 255.255.255.0 for 10.1.2.0/24.
+func cidrNetmask(prefix string) (string, error) {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return "", err
+	}
+	if len(ipnet.Mask) != net.IPv4len {
+		return "", fmt.Errorf("not an IPv4 prefix: %s", prefix)
+	}
+	return net.IP(ipnet.Mask).String(), nil
+}
+
+// Checks whether the address (with or without prefix length) belongs to the network prefix.
+func inSubnet(prefix, addr string) (bool, error) {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return false, err
+	}
+
+	if i := strings.Index(addr, "/"); i >= 0 {
+		addr = addr[:i]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false, fmt.Errorf("incorrect IP address: %s", addr)
+	}
+
+	return ipnet.Contains(ip), nil
+}
+
 func ternariusIf(flag bool, retValues string) string {
 	var trueValue, falseValue string
 
@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+var netTestData = map[string]interface{}{
+	"Iface": NetIf{Name: "eth0", IP4Addrs: []string{"10.1.2.3/24", "10.1.3.3/24"}},
+	"Empty": NetIf{Name: "eth1"},
+}
+
+func TestNetworkFuncs(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		// cidrHost
+		{`{{ cidrHost "10.1.2.0/24" 5 }}`, "10.1.2.5"},
+		{`{{ cidrHost "10.1.2.7/24" 0 }}`, "10.1.2.0"},
+		{`{{ cidrHost "10.1.2.0/24" -1 }}`, "10.1.2.255"},
+		{`{{ cidrHost "10.1.2.0/24" -256 }}`, "10.1.2.0"},
+		{`{{ cidrHost "10.1.0.0/16" 258 }}`, "10.1.1.2"},
+		{`{{ cidrHost "10.1.2.3/32" 0 }}`, "10.1.2.3"},
+		{`{{ cidrHost "2001:db8::/64" 1 }}`, "2001:db8::1"},
+		{`{{ cidrHost "2001:db8::/64" -1 }}`, "2001:db8::ffff:ffff:ffff:ffff"},
+		{`{{ cidrHost "2001:db8::/120" 255 }}`, "2001:db8::ff"},
+
+		// cidrNetmask
+		{`{{ cidrNetmask "10.1.2.0/24" }}`, "255.255.255.0"},
+		{`{{ cidrNetmask "10.0.0.0/8" }}`, "255.0.0.0"},
+		{`{{ cidrNetmask "10.1.2.3/32" }}`, "255.255.255.255"},
+		{`{{ cidrNetmask "0.0.0.0/0" }}`, "0.0.0.0"},
+
+		// inSubnet
+		{`{{ inSubnet "10.1.2.0/24" "10.1.2.200" }}`, "true"},
+		{`{{ inSubnet "10.1.2.0/24" "10.1.3.1" }}`, "false"},
+		{`{{ inSubnet "10.1.2.0/24" "10.1.2.3/16" }}`, "true"},
+		{`{{ inSubnet "10.1.2.0/24" "10.1.3.3/16" }}`, "false"},
+		{`{{ inSubnet "2001:db8::/32" "2001:db8:1::1/64" }}`, "true"},
+		{`{{ inSubnet "2001:db8::/32" "10.1.2.3" }}`, "false"},
+		{`{{ inSubnet "10.1.2.0/24" (firstIP4 .Iface) }}`, "true"},
+
+		// firstIP4
+		{`{{ firstIP4 .Iface }}`, "10.1.2.3/24"},
+		{`{{ firstIP4 .Empty }}`, ""},
+	}
+
+	for _, tt := range tests {
+		got, err := executeText(tt.text, netTestData)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.text, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestNetworkFuncsErrors(t *testing.T) {
+	tests := []string{
+		`{{ cidrHost "10.1.2.0/24" 256 }}`,
+		`{{ cidrHost "10.1.2.0/24" -257 }}`,
+		`{{ cidrHost "10.1.2.3/32" 1 }}`,
+		`{{ cidrHost "2001:db8::/120" 256 }}`,
+		`{{ cidrHost "10.1.2.0" 1 }}`,
+		`{{ cidrNetmask "2001:db8::/64" }}`,
+		`{{ cidrNetmask "10.1.2.0/33" }}`,
+		`{{ inSubnet "10.1.2.0" "10.1.2.3" }}`,
+		`{{ inSubnet "10.1.2.0/24" "10.1.2" }}`,
+		`{{ inSubnet "10.1.2.0/24" "" }}`,
+	}
+
+	for _, text := range tests {
+		if got, err := executeText(text, netTestData); err == nil {
+			t.Errorf("%s: expected an error, got %q", text, got)
+		}
+	}
+}
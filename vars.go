@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Returns the custom variables of a given host merged from the files
+// in the VARSDIR in the following order (later ones override earlier ones):
+//
+//	vars/common.yaml
+//	vars/groups/<group>.yaml   for each inventory group of the host, sorted by name
+//	vars/hosts/<fqdn>.yaml     or vars/hosts/<hostname>.yaml if there is no such file
+//
+// and the JSON output of myenvs (if defined) on top of them. The groups are
+// looked up by the hostname or FQDN in the inventory file only, ./agents is not run.
+func loadCustomVariables(hostname, fqdn string, myenvs []byte) (CustomVariables, error) {
+	vars := make(map[string]interface{})
+
+	files := []string{path.Join(VARSDIR, "common.yaml")}
+
+	if _, err := os.Stat(path.Join(VARSDIR, "groups")); err == nil {
+		inv, err := loadStaticInventory()
+		if err != nil {
+			return nil, err
+		}
+		groups, err := inv.GroupsOf(hostname, fqdn)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			files = append(files, path.Join(VARSDIR, "groups", g+".yaml"))
+		}
+	}
+
+	hostFile := path.Join(VARSDIR, "hosts", hostname+".yaml")
+	if fqdn != "" && fqdn != hostname {
+		if fname := path.Join(VARSDIR, "hosts", fqdn+".yaml"); isFile(fname) {
+			hostFile = fname
+		}
+	}
+	files = append(files, hostFile)
+
+	for _, fname := range files {
+		var v map[string]interface{}
+
+		switch c, err := ioutil.ReadFile(fname); {
+		case err == nil:
+			if err := yaml.Unmarshal(c, &v); err != nil {
+				return nil, fmt.Errorf("%s: %s", fname, err)
+			}
+		case os.IsNotExist(err):
+			continue
+		default:
+			return nil, err
+		}
+
+		vars = mergeMaps(vars, normalizeValue(v).(map[string]interface{}))
+	}
+
+	if len(myenvs) > 0 {
+		var v map[string]interface{}
+		if err := json.Unmarshal(myenvs, &v); err != nil {
+			return nil, fmt.Errorf("myenvs: %s", err)
+		}
+		vars = mergeMaps(vars, v)
+	}
+
+	return vars, nil
+}
+
+// Deeply merges src into dst: nested maps are merged, all other values
+// (including lists) are replaced.
+func mergeMaps(dst, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		dm, ok1 := dst[k].(map[string]interface{})
+		sm, ok2 := v.(map[string]interface{})
+		if ok1 && ok2 {
+			dst[k] = mergeMaps(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+	return dst
+}
+
+// Converts the maps decoded from YAML to map[string]interface{},
+// so the values look like the ones decoded from JSON.
+func normalizeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, v := range x {
+			m[fmt.Sprint(k)] = normalizeValue(v)
+		}
+		return m
+	case map[string]interface{}:
+		if x == nil {
+			return make(map[string]interface{})
+		}
+		for k, v := range x {
+			x[k] = normalizeValue(v)
+		}
+		return x
+	case []interface{}:
+		for i, v := range x {
+			x[i] = normalizeValue(v)
+		}
+		return x
+	}
+	return v
+}
+
+// Checks whether fname exists and is not a directory.
+func isFile(fname string) bool {
+	fi, err := os.Stat(fname)
+	return err == nil && !fi.IsDir()
+}
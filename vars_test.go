@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCustomVariablesHostFile(t *testing.T) {
+	dir := t.TempDir()
+
+	defer func(d string) { VARSDIR = d }(VARSDIR)
+	VARSDIR = dir
+
+	if err := os.MkdirAll(filepath.Join(dir, "hosts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"common.yaml":                  "common: 1\nname: common\n",
+		"hosts/web1.yaml":              "name: short\n",
+		"hosts/web1.example.com.yaml":  "name: fqdn\n",
+		"hosts/db1.yaml":               "name: db1\n",
+		"hosts/db1.other.example.yaml": "name: other\n",
+	}
+	for name, c := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		hostname, fqdn string
+		want           string
+	}{
+		// The FQDN goes first
+		{"web1", "web1.example.com", "fqdn"},
+		// Then the short hostname
+		{"db1", "db1.example.com", "db1"},
+		{"db1", "", "db1"},
+		// Only common variables
+		{"app1", "app1.example.com", "common"},
+	}
+
+	for _, tt := range tests {
+		vars, err := loadCustomVariables(tt.hostname, tt.fqdn, nil)
+		if err != nil {
+			t.Errorf("%s (%s): unexpected error: %s", tt.hostname, tt.fqdn, err)
+			continue
+		}
+		if vars["name"] != tt.want || vars["common"] != 1 {
+			t.Errorf("%s (%s): got %v, want name %q", tt.hostname, tt.fqdn, vars, tt.want)
+		}
+	}
+}